@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync-kline/config"
+	"sync-kline/engine"
+	"sync-kline/mongo"
+)
+
+// backfill 分页补历史数据，source、symbol、period 为空时补全部
+func backfill(confPath string, from string, source string, symbol string, period string) error {
+
+	conf, err := config.NewConfig(confPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := mongo.NewTrade(conf.Mongo.Uri, conf.Mongo.Database)
+	if err != nil {
+		return err
+	}
+
+	eng, err := engine.NewEngine(context.Background(), db, &conf.Mongo, &conf.Engine)
+	if err != nil {
+		return err
+	}
+	defer eng.Close()
+
+	if from == "" {
+		from = conf.Engine.Backfill.From
+	}
+	fromTime, err := eng.ParseDate(from)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range eng.Sources() {
+		if source != "" && source != name {
+			continue
+		}
+
+		periods := eng.Periods(name)
+		if period != "" {
+			periods = []string{period}
+		}
+
+		for _, item := range eng.Symbols(name) {
+			if symbol != "" && engine.NormalizeSymbol(symbol) != engine.NormalizeSymbol(item) {
+				continue
+			}
+			for _, p := range periods {
+				fmt.Printf("正在补%s交易对：%s -- %s 的历史记录\n", name, item, p)
+				err := eng.Backfill(name, item, p, fromTime, conf.Engine.Backfill.Rate)
+				if errors.Is(err, engine.ErrPeriodNotSupported) {
+					fmt.Println(err, "，补齐 1min 后可以用 rebuild 命令生成")
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	fmt.Println("补数据完成")
+
+	return nil
+}
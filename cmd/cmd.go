@@ -26,6 +26,43 @@ func Run(isSwag bool) {
 		},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "migrate",
+			Usage: "旧数据升级：没有数据源前缀的K线集合改名到默认数据源，字符串存储的价格数量转换成 Decimal128，合并重复的K线并创建唯一索引",
+			Action: func(c *cli.Context) error {
+				return migrate(c.GlobalString("conf"))
+			},
+		},
+		{
+			Name:  "backfill",
+			Usage: "从当前往前分页补齐历史K线，中断后再次执行会继续",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "from", Usage: "开始日期，如 2020-01-01，默认使用配置"},
+				cli.StringFlag{Name: "source", Usage: "只补该数据源"},
+				cli.StringFlag{Name: "symbol", Usage: "只补该交易对"},
+				cli.StringFlag{Name: "period", Usage: "只补该周期，默认使用数据源配置的周期"},
+			},
+			Action: func(c *cli.Context) error {
+				return backfill(c.GlobalString("conf"), c.String("from"), c.String("source"), c.String("symbol"), c.String("period"))
+			},
+		},
+		{
+			Name:  "rebuild",
+			Usage: "用 1min K线重新生成其它周期的K线",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "from", Usage: "开始日期，如 2020-01-01，默认从最早的数据开始"},
+				cli.StringFlag{Name: "to", Usage: "结束日期（不包含），默认到最新"},
+				cli.StringFlag{Name: "source", Usage: "只重新生成该数据源"},
+				cli.StringFlag{Name: "symbol", Usage: "只重新生成该交易对"},
+				cli.StringFlag{Name: "period", Usage: "只重新生成该周期，默认 1min 以外的全部周期"},
+			},
+			Action: func(c *cli.Context) error {
+				return rebuild(c.GlobalString("conf"), c.String("from"), c.String("to"), c.String("source"), c.String("symbol"), c.String("period"))
+			},
+		},
+	}
+
 	app.Action = func(c *cli.Context) error {
 
 		if printVersion {
@@ -34,7 +71,10 @@ func Run(isSwag bool) {
 		}
 
 		conf := c.String("conf")
-		server.Start(isSwag, conf)
+		if err := server.Start(isSwag, conf); err != nil {
+			// 引擎出错退出时返回非 0
+			return cli.NewExitError(err.Error(), 1)
+		}
 
 		return nil
 	}
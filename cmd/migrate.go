@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"sync-kline/config"
+	"sync-kline/engine"
+	"sync-kline/mongo"
+)
+
+// migrate 旧数据转换
+func migrate(confPath string) error {
+
+	conf, err := config.NewConfig(confPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := mongo.NewTrade(conf.Mongo.Uri, conf.Mongo.Database)
+	if err != nil {
+		return err
+	}
+
+	// 先把没有前缀的集合改名，再转换
+	err = engine.MigrateNamespace(db, &conf.Mongo, &conf.Engine)
+	if err != nil {
+		return err
+	}
+
+	err = engine.MigrateDecimal(db, &conf.Mongo, &conf.Engine)
+	if err != nil {
+		return err
+	}
+
+	// 转换之后才能合并
+	err = engine.MigrateDuplicates(db, &conf.Mongo, &conf.Engine)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("转换完成")
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync-kline/config"
+	"sync-kline/engine"
+	"sync-kline/mongo"
+)
+
+// rebuild 用 1min K线重新生成其它周期，source、symbol、period 为空时生成全部
+func rebuild(confPath string, from string, to string, source string, symbol string, period string) error {
+
+	conf, err := config.NewConfig(confPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := mongo.NewTrade(conf.Mongo.Uri, conf.Mongo.Database)
+	if err != nil {
+		return err
+	}
+
+	eng, err := engine.NewEngine(context.Background(), db, &conf.Mongo, &conf.Engine)
+	if err != nil {
+		return err
+	}
+	defer eng.Close()
+
+	var fromTime, toTime int64
+	if from != "" {
+		if fromTime, err = eng.ParseDate(from); err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		if toTime, err = eng.ParseDate(to); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range eng.Sources() {
+		if source != "" && source != name {
+			continue
+		}
+
+		var periods []string
+		if period != "" {
+			periods = []string{period}
+		} else {
+			for _, p := range eng.Periods(name) {
+				if p != "1min" {
+					periods = append(periods, p)
+				}
+			}
+		}
+		for _, item := range eng.Symbols(name) {
+			if symbol != "" && engine.NormalizeSymbol(symbol) != engine.NormalizeSymbol(item) {
+				continue
+			}
+			for _, p := range periods {
+				fmt.Printf("正在重新生成%s交易对：%s -- %s\n", name, item, p)
+				if err := eng.Rebuild(name, item, p, fromTime, toTime); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	fmt.Println("重新生成完成")
+
+	return nil
+}
@@ -5,26 +5,73 @@ import (
 )
 
 type AppConfig struct {
-	Port uint `yaml:"port"`
+	Port            uint `yaml:"port"`
+	ShutdownTimeout int  `yaml:"shutdown_timeout" default:"10000"` // 退出时等待K线写入和请求处理完的最长时间（毫秒）
 }
 
 type MongoConfig struct {
-	Uri string `yaml:"uri"`
+	Uri       string `yaml:"uri"`
+	Database  string `yaml:"database" default:"trade"`       // 数据库名
+	Namespace string `yaml:"namespace" default:"collection"` // 数据源隔离方式：collection 集合名加前缀 huobi_btcusdt_1min，database 每个数据源一个库 trade_huobi
 }
 
-type EngineConfig struct {
+type SourceConfig struct {
+	Name     string   `yaml:"name"`      // 名称，为空时使用平台名，同一个平台配置多次时必须填写
 	Platform string   `yaml:"platform"`  // 平台
 	ProxyUrl string   `yaml:"proxy_url"` // 代理
 	WsUrl    string   `yaml:"ws_url"`    // ws链接
 	HttpUrl  string   `yaml:"http_url"`  // http链接
 	Symbols  []string `yaml:"symbols"`   // 交易对
-	Periods  []string `yaml:"periods"`   // 交易对
+	Periods  []string `yaml:"periods"`   // 同步的周期，为空时同步全部标准周期 1min 5min 15min 30min 1hour 4hour 1day 1week 1mon 1year，也可以写 3m、2h、12h、3d、2w、3M 这样的周期
+	Timezone string   `yaml:"timezone"`  // K线切分的时区，和交易所的历史K线保持一致，为空时 binance 使用 UTC，其它平台使用 engine.timezone
+}
+
+type QueueConfig struct {
+	Size     int    `yaml:"size" default:"10000"`           // 每个数据源收到的成交在内存中最多缓存的数量
+	Overflow string `yaml:"overflow" default:"spill"`       // 缓存满时：spill 写入磁盘，drop_oldest 丢弃最早的，block 等待（会耽误心跳导致断线）
+	SpillDir string `yaml:"spill_dir" default:"data/spill"` // spill 写入的目录，每个数据源一个文件，只在运行中使用
+}
+
+type WalConfig struct {
+	Enable      bool   `yaml:"enable"`                    // 聚合之前把成交写入本地文件，数据库写入失败或者进程退出后重新聚合
+	Dir         string `yaml:"dir" default:"data/wal"`    // 目录
+	SegmentSize int    `yaml:"segment_size" default:"64"` // 分段文件大小（MB），写入数据库之后的分段删除
+}
+
+type BackfillConfig struct {
+	From string `yaml:"from" default:"2020-01-01"` // 补历史数据的开始日期，按 timezone 解析
+	Rate int    `yaml:"rate" default:"5"`          // 每秒最多请求次数
+}
+
+type EngineConfig struct {
+	Sources       []SourceConfig `yaml:"sources"`                          // 数据源，每个数据源单独的平台和交易对
+	FlushInterval int            `yaml:"flush_interval" default:"1000"`    // K线批量写入间隔（毫秒），收盘时会立即写入
+	Timezone      string         `yaml:"timezone" default:"Asia/Shanghai"` // 日、周、月、年K线按该时区的零点切分，如 UTC、Asia/Shanghai，数据源没有配置时使用
+	CloseDelay    int            `yaml:"close_delay" default:"2000"`       // K线结束后等待迟到成交的时间（毫秒），没有新成交时到时间收盘
+	DedupWindow   int            `yaml:"dedup_window" default:"10000"`     // 每个交易对按成交 ID 去重保留的最近 ID 数量，-1 不去重
+	Shards        int            `yaml:"shards" default:"4"`               // 聚合的分片数，同一个交易对的成交在同一个分片按顺序处理
+	ShardQueue    int            `yaml:"shard_queue" default:"10000"`      // 每个分片等待处理的成交数量，满了之后等待，成交留在 worker 的队列中
+	Aggregation   string         `yaml:"aggregation" default:"trade"`      // trade 每个周期都由成交计算，rollup 只由成交计算 1min，其它周期由收盘的低周期K线合并
+	Queue         QueueConfig    `yaml:"queue"`                            // 交易所推送到聚合之间的队列
+	Wal           WalConfig      `yaml:"wal"`                              // 收到的成交先写入本地 wal
+	Backfill      BackfillConfig `yaml:"backfill"`                         // backfill 命令分页补历史数据
+}
+
+type PublisherConfig struct {
+	Enable      bool   `yaml:"enable"`                     // 是否发送到消息总线
+	Transport   string `yaml:"transport" default:"memory"` // 消息总线，memory 进程内
+	TopicPrefix string `yaml:"topic_prefix"`               // 主题前缀，如 prod. 则主题为 prod.kline.btcusdt.1min
+	Trades      bool   `yaml:"trades"`                     // 是否发送逐笔成交 trade.btcusdt
+	Buffer      int    `yaml:"buffer" default:"10000"`     // 等待发送的消息缓冲，满了之后丢弃新消息
+	Retries     int    `yaml:"retries" default:"-1"`       // 发送失败的重试次数，之后丢弃这条消息，-1 一直重试，只有缓冲满时丢弃
+	CloseWait   int    `yaml:"close_wait" default:"5000"`  // 退出时等待发送完缓冲中消息的时间（毫秒）
 }
 
 type Config struct {
-	App    AppConfig
-	Mongo  MongoConfig
-	Engine EngineConfig
+	App       AppConfig
+	Mongo     MongoConfig
+	Engine    EngineConfig
+	Publisher PublisherConfig
 }
 
 func NewConfig(confPath string) (Config, error) {
@@ -0,0 +1,425 @@
+package engine
+
+import (
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"sort"
+	"sync"
+)
+
+// seriesKey 一个数据源交易对周期的K线序列
+type seriesKey struct {
+	name   string
+	symbol string
+	period string
+}
+
+// candleDelta 上次写入之后的增量
+type candleDelta struct {
+	open       decimal.Decimal
+	close      decimal.Decimal
+	low        decimal.Decimal
+	high       decimal.Decimal
+	amount     decimal.Decimal
+	vol        decimal.Decimal
+	count      int
+	buyAmount  decimal.Decimal
+	sellAmount decimal.Decimal
+	buyVol     decimal.Decimal
+	seq        uint64 // 合并过的最大的 wal 序号，和增量一起写入
+}
+
+// candle 内存中的一根K线，kLine 为完整数据用于推送，delta 为还没写入的增量
+type candle struct {
+	kLine   KLine
+	delta   candleDelta
+	end     int64 // 下一根K线的开始时间
+	closed  bool  // 已收盘
+	emitted bool  // 已经通知过收盘，之后的成交为迟到的成交
+}
+
+// closedCandle 收盘的K线
+type closedCandle struct {
+	key  seriesKey
+	item *candle
+}
+
+// closedKLine 需要通知的收盘K线
+type closedKLine struct {
+	key   seriesKey
+	kLine KLine
+}
+
+// pendingKLine 待写入的增量
+type pendingKLine struct {
+	time  int64
+	delta candleDelta
+}
+
+// candleUpdate 一笔成交要合并的一个周期的K线，seed 为数据库中已有的数据
+type candleUpdate struct {
+	key  seriesKey
+	ts   int64
+	end  int64
+	seed *KLine
+}
+
+// flushBatch 一次写入的内容，增量、成交 ID 和 wal 序号在同一个锁内取出
+// marks 中的成交和 wal 中小于等于 walMark 的成交都已经合并到 kLines 或者之前写入的增量中
+type flushBatch struct {
+	kLines  map[seriesKey][]pendingKLine
+	marks   map[dedupKey]int64
+	walMark uint64
+}
+
+// aggregator 内存K线聚合，只保留每个序列未收盘的K线和还没写入的K线
+type aggregator struct {
+	mu       sync.Mutex
+	candles  map[seriesKey]map[int64]*candle
+	open     map[seriesKey]int64 // 每个序列最新的K线时间
+	closedAt map[seriesKey]int64 // 每个序列最后收盘的K线时间
+	closed   []closedCandle      // 还没通知的收盘K线
+	marks    map[dedupKey]int64  // 上次写入之后合并过的最大成交 ID
+	wal      *tradeWal           // 没有开启时为 nil
+	flushCh  chan struct{}
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		candles:  make(map[seriesKey]map[int64]*candle),
+		open:     make(map[seriesKey]int64),
+		closedAt: make(map[seriesKey]int64),
+		marks:    make(map[dedupKey]int64),
+		flushCh:  make(chan struct{}, 1),
+	}
+}
+
+// has K线是否在内存中
+func (a *aggregator) has(key seriesKey, ts int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.candles[key][ts]
+	return ok
+}
+
+// apply 把一笔成交合并到各个周期的K线并记录成交 ID 和 wal 序号（没有写入 wal 时为 0），返回合并后的K线
+// 和 take 互斥，取出的增量总是包含一笔成交的所有周期，成交 ID 和 wal 序号与增量一致
+func (a *aggregator) apply(updates []candleUpdate, mark dedupKey, id int64, seq uint64, price decimal.Decimal, amount decimal.Decimal, side string) []KLine {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	kLines := make([]KLine, len(updates))
+	for i, u := range updates {
+		kLines[i] = a.updateLocked(u.key, u.ts, u.end, u.seed, seq, price, amount, side)
+	}
+	if id > a.marks[mark] {
+		a.marks[mark] = id
+	}
+	if seq > 0 && a.wal != nil {
+		a.wal.applied(seq)
+	}
+	return kLines
+}
+
+// updateLocked 把成交合并到 [ts, end) 的K线，K线不在内存时以 seed 为初始值（数据库中已有的数据）
+// seq 不大于数据库中K线的 WalSeq 时成交已经写入过（上次写入部分集合失败后退出），只推进开盘收盘不再累加
+// 返回合并后的K线，有新的K线开盘时上一根收盘，并通知立即写入
+func (a *aggregator) updateLocked(key seriesKey, ts int64, end int64, seed *KLine, seq uint64, price decimal.Decimal, amount decimal.Decimal, side string) KLine {
+
+	candles, ok := a.candles[key]
+	if !ok {
+		candles = make(map[int64]*candle)
+		a.candles[key] = candles
+	}
+
+	openTime, hasOpen := a.open[key]
+
+	item, ok := candles[ts]
+	if !ok {
+		item = &candle{end: end}
+		if seed != nil {
+			item.kLine = *seed
+		}
+		item.kLine.Time = ts
+		// 已经收盘的K线的迟到成交，不再通知收盘
+		if (hasOpen && ts < openTime) || ts <= a.closedAt[key] {
+			item.closed = true
+			item.emitted = true
+		}
+		candles[ts] = item
+	}
+
+	if seq == 0 || seq > item.kLine.WalSeq {
+		klineAddTrade(&item.kLine, price, amount, side)
+		item.delta.add(price, amount, side)
+		if seq > item.delta.seq {
+			item.delta.seq = seq
+		}
+	}
+
+	if !hasOpen || ts > openTime {
+		a.open[key] = ts
+		if hasOpen {
+			if prev, ok := candles[openTime]; ok {
+				a.closeLocked(key, prev)
+			}
+			a.notifyFlush()
+		}
+	}
+
+	return item.kLine
+}
+
+// mergeRange 按时间顺序把内存中 [from, to) 之间的K线合并到 dst
+func (a *aggregator) mergeRange(key seriesKey, from int64, to int64, dst *KLine) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var times []int64
+	for ts := range a.candles[key] {
+		if ts >= from && ts < to {
+			times = append(times, ts)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	for _, ts := range times {
+		klineMerge(dst, &a.candles[key][ts].kLine)
+	}
+}
+
+// expire 没有新的成交时，结束时间早于 now 的K线按时间收盘，返回收盘的数量
+func (a *aggregator) expire(now int64) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	count := 0
+	for key, ts := range a.open {
+		item, ok := a.candles[key][ts]
+		if ok && !item.closed && item.end <= now {
+			a.closeLocked(key, item)
+			count++
+		}
+	}
+	return count
+}
+
+func (a *aggregator) closeLocked(key seriesKey, item *candle) {
+	if item.closed {
+		return
+	}
+	item.closed = true
+	if item.kLine.Time > a.closedAt[key] {
+		a.closedAt[key] = item.kLine.Time
+	}
+	a.closed = append(a.closed, closedCandle{key: key, item: item})
+}
+
+// takeClosed 取出还没通知的收盘K线，已经写入的从内存移除
+func (a *aggregator) takeClosed() []closedKLine {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make([]closedKLine, len(a.closed))
+	for i, c := range a.closed {
+		c.item.emitted = true
+		result[i] = closedKLine{key: c.key, kLine: c.item.kLine}
+		if c.item.delta.count == 0 {
+			delete(a.candles[c.key], c.item.kLine.Time)
+		}
+	}
+	a.closed = nil
+	return result
+}
+
+// take 取出所有待写入的增量和对应的成交 ID、wal 序号
+func (a *aggregator) take() flushBatch {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	batch := flushBatch{
+		kLines: make(map[seriesKey][]pendingKLine),
+		marks:  a.marks,
+	}
+	for key, candles := range a.candles {
+		for ts, item := range candles {
+			if item.delta.count > 0 {
+				batch.kLines[key] = append(batch.kLines[key], pendingKLine{time: ts, delta: item.delta})
+				item.delta = candleDelta{}
+			}
+		}
+	}
+	a.marks = make(map[dedupKey]int64)
+	if a.wal != nil {
+		batch.walMark = a.wal.mark()
+	}
+	return batch
+}
+
+// restoreMarks 写入失败时把成交 ID 放回去，和下次的增量一起保存
+func (a *aggregator) restoreMarks(marks map[dedupKey]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, id := range marks {
+		if id > a.marks[key] {
+			a.marks[key] = id
+		}
+	}
+}
+
+// restore 写入失败时把增量放回去，下次重试
+func (a *aggregator) restore(key seriesKey, items []pendingKLine) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	candles := a.candles[key]
+	for _, p := range items {
+		item, ok := candles[p.time]
+		if !ok {
+			continue
+		}
+		delta := p.delta
+		delta.merge(&item.delta)
+		item.delta = delta
+	}
+}
+
+// markFlushed 写入成功后，已收盘且没有新增量的K线从内存移除
+// 返回已经通知过收盘之后又写入了迟到成交的K线时间
+func (a *aggregator) markFlushed(key seriesKey, items []pendingKLine) []int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var late []int64
+	candles := a.candles[key]
+	for _, p := range items {
+		item, ok := candles[p.time]
+		if !ok || !item.closed {
+			continue
+		}
+		if item.emitted {
+			late = append(late, p.time)
+		}
+		if item.emitted && item.delta.count == 0 {
+			delete(candles, p.time)
+		}
+	}
+	return late
+}
+
+// notifyFlush 通知立即写入，不阻塞
+func (a *aggregator) notifyFlush() {
+	select {
+	case a.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (d *candleDelta) add(price decimal.Decimal, amount decimal.Decimal, side string) {
+	if d.count == 0 {
+		d.open = price
+		d.low = price
+		d.high = price
+		d.amount = decimal0
+		d.vol = decimal0
+		d.buyAmount = decimal0
+		d.sellAmount = decimal0
+		d.buyVol = decimal0
+	}
+	d.close = price
+	d.low = decimal.Min(d.low, price)
+	d.high = decimal.Max(d.high, price)
+	d.amount = d.amount.Add(amount)
+	d.vol = d.vol.Add(amount.Mul(price))
+	d.count++
+
+	switch side {
+	case SideBuy:
+		d.buyAmount = d.buyAmount.Add(amount)
+		d.buyVol = d.buyVol.Add(amount.Mul(price))
+	case SideSell:
+		d.sellAmount = d.sellAmount.Add(amount)
+	}
+}
+
+// merge 合并之后的增量
+func (d *candleDelta) merge(next *candleDelta) {
+	if next.count == 0 {
+		return
+	}
+	if d.count == 0 {
+		*d = *next
+		return
+	}
+	d.close = next.close
+	d.low = decimal.Min(d.low, next.low)
+	d.high = decimal.Max(d.high, next.high)
+	d.amount = d.amount.Add(next.amount)
+	d.vol = d.vol.Add(next.vol)
+	d.count += next.count
+	if next.seq > d.seq {
+		d.seq = next.seq
+	}
+	d.buyAmount = d.buyAmount.Add(next.buyAmount)
+	d.sellAmount = d.sellAmount.Add(next.sellAmount)
+	d.buyVol = d.buyVol.Add(next.buyVol)
+}
+
+// update 转成原子更新：开盘价只在插入时写入，最高最低取极值，数量累加
+// wal 序号和增量在同一次更新中写入，部分集合写入失败时已经写入的K线重新聚合会跳过
+func (d *candleDelta) update() bson.M {
+	max := bson.M{"high": toDecimal128(d.high)}
+	if d.seq > 0 {
+		max["walseq"] = int64(d.seq)
+	}
+	return bson.M{
+		"$setOnInsert": bson.M{"open": toDecimal128(d.open)},
+		"$set":         bson.M{"close": toDecimal128(d.close)},
+		"$min":         bson.M{"low": toDecimal128(d.low)},
+		"$max":         max,
+		"$inc": bson.M{
+			"amount":     toDecimal128(d.amount),
+			"vol":        toDecimal128(d.vol),
+			"count":      d.count,
+			"buyamount":  toDecimal128(d.buyAmount),
+			"sellamount": toDecimal128(d.sellAmount),
+			"buyvol":     toDecimal128(d.buyVol),
+		},
+	}
+}
+
+// klineAddTrade 把一笔成交合并到K线
+func klineAddTrade(kLine *KLine, price decimal.Decimal, amount decimal.Decimal, side string) {
+
+	if fromDecimal128(kLine.Open).Cmp(decimal0) <= 0 {
+		kLine.Open = toDecimal128(price)
+	}
+	kLine.Close = toDecimal128(price)
+	low := fromDecimal128(kLine.Low)
+	if low.Cmp(decimal0) <= 0 {
+		kLine.Low = toDecimal128(price)
+	} else {
+		kLine.Low = toDecimal128(decimal.Min(low, price))
+	}
+	high := fromDecimal128(kLine.High)
+	if high.Cmp(decimal0) <= 0 {
+		kLine.High = toDecimal128(price)
+	} else {
+		kLine.High = toDecimal128(decimal.Max(high, price))
+	}
+
+	kLine.Amount = toDecimal128(fromDecimal128(kLine.Amount).Add(amount))
+	kLine.Vol = toDecimal128(fromDecimal128(kLine.Vol).Add(amount.Mul(price)))
+	kLine.Count += 1
+
+	switch side {
+	case SideBuy:
+		kLine.BuyAmount = toDecimal128(fromDecimal128(kLine.BuyAmount).Add(amount))
+		kLine.BuyVol = toDecimal128(fromDecimal128(kLine.BuyVol).Add(amount.Mul(price)))
+	case SideSell:
+		kLine.SellAmount = toDecimal128(fromDecimal128(kLine.SellAmount).Add(amount))
+	}
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+// 重新聚合时，数据库中K线的 WalSeq 之前的成交已经写入，不再累加
+func TestAggregatorSkipsFlushedWalSeq(t *testing.T) {
+	a := newAggregator()
+	key := seriesKey{name: "huobi", symbol: "btcusdt", period: "1min"}
+	mark := dedupKey{name: "huobi", symbol: "btcusdt"}
+	price, amount := decimal.NewFromInt(100), decimal.NewFromInt(1)
+
+	seed := &KLine{Time: 60, Count: 2, WalSeq: 5}
+	seed.Open = toDecimal128(price)
+	seed.Close = toDecimal128(price)
+	seed.Low = toDecimal128(price)
+	seed.High = toDecimal128(price)
+	seed.Amount = toDecimal128(decimal.NewFromInt(2))
+
+	update := candleUpdate{key: key, ts: 60, end: 120, seed: seed}
+	if k := a.apply([]candleUpdate{update}, mark, 0, 4, price, amount, SideBuy); k[0].Count != 2 {
+		t.Fatalf("seq 4 merged, count = %d", k[0].Count)
+	}
+	update.seed = nil
+	if k := a.apply([]candleUpdate{update}, mark, 0, 5, price, amount, SideBuy); k[0].Count != 2 {
+		t.Fatalf("seq 5 merged, count = %d", k[0].Count)
+	}
+	if k := a.apply([]candleUpdate{update}, mark, 0, 6, price, amount, SideBuy); k[0].Count != 3 {
+		t.Fatalf("seq 6 not merged, count = %d", k[0].Count)
+	}
+	// 没有写入 wal 的成交总是合并
+	if k := a.apply([]candleUpdate{update}, mark, 0, 0, price, amount, SideBuy); k[0].Count != 4 {
+		t.Fatalf("trade without seq not merged, count = %d", k[0].Count)
+	}
+
+	batch := a.take()
+	items := batch.kLines[key]
+	if len(items) != 1 || items[0].delta.count != 2 || items[0].delta.seq != 6 {
+		t.Fatalf("pending = %+v", items)
+	}
+	if got := items[0].delta.update()["$max"].(bson.M)["walseq"]; got != int64(6) {
+		t.Fatalf("$max walseq = %v, want 6", got)
+	}
+
+	// 写入失败放回后和之后的增量合并，序号取最大
+	a.restore(key, items)
+	a.apply([]candleUpdate{update}, mark, 0, 7, price, amount, SideBuy)
+	items = a.take().kLines[key]
+	if len(items) != 1 || items[0].delta.count != 3 || items[0].delta.seq != 7 {
+		t.Fatalf("restored pending = %+v", items)
+	}
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// repairDelay K线收盘后等待交易所生成最终数据的时间
+const repairDelay = 10 * time.Second
+
+// backfillGap 重连后补齐断线期间的K线
+// 从数据库最后一根K线到当前未收盘的K线之间，已收盘的K线直接用交易所的数据覆盖，不会和已聚合的成交重复累加；
+// 当前K线还在聚合实时成交，等收盘后再用交易所的数据覆盖
+func (c *ConCurrentEngine) backfillGap(s *source) {
+
+	s.backfillMu.Lock()
+	defer s.backfillMu.Unlock()
+
+	// 先把内存中的增量写入，数据库中的最后时间才是准确的
+	c.flush()
+
+	now := time.Now().Unix()
+	for _, symbol := range s.config.Symbols {
+		for _, period := range s.periods {
+			last, err := c.lastKLineTime(s.name, symbol, period)
+			if err != nil {
+				fmt.Println("查询最后一根K线失败", s.name, symbol, period, err)
+				continue
+			}
+			if last == 0 {
+				// 没有数据，由启动时获取历史数据处理
+				continue
+			}
+
+			current, _ := klineCreateDateTime(now, period, 1, s.location)
+			if last < current {
+				fmt.Printf("正在补齐%s交易对：%s -- %s 断线期间的K线\n", s.name, symbol, period)
+				c.replaceHistory(s, symbol, period, last, current)
+			}
+			c.repairAfterClose(s, symbol, period, current)
+		}
+	}
+}
+
+// repairAfterClose 断线时未收盘的K线缺少断线期间的成交，收盘后用交易所的数据覆盖
+// 每个交易对周期只保留一个等待中的修复，再次断线时替换之前的，需要持有 backfillMu
+func (c *ConCurrentEngine) repairAfterClose(s *source, symbol string, period string, current int64) {
+
+	// 往前 -1 根即下一根K线的开始时间
+	_, next := klineCreateDateTime(current, period, -1, s.location)
+	delay := time.Until(time.Unix(next, 0)) + repairDelay
+
+	key := normalizeSymbol(symbol) + "_" + period
+	if s.repairs == nil {
+		s.repairs = make(map[string]*time.Timer)
+	}
+	if prev, ok := s.repairs[key]; ok {
+		// 之前的K线已经收盘，这次的补齐已经覆盖
+		prev.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		s.backfillMu.Lock()
+		defer s.backfillMu.Unlock()
+
+		if s.repairs[key] != timer {
+			return
+		}
+		delete(s.repairs, key)
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		c.flush()
+		c.replaceHistory(s, symbol, period, current, next)
+	})
+	s.repairs[key] = timer
+}
+
+// replaceHistory 用交易所的K线覆盖 [from, to) 之间的K线
+func (c *ConCurrentEngine) replaceHistory(s *source, symbol string, period string, from int64, to int64) {
+
+	kLines, err := s.worker.HistoryKline(symbol, period)
+	if err != nil {
+		fmt.Println("获取历史K线失败", s.name, symbol, period, err)
+		return
+	}
+
+	var items []*KLine
+	earliest := int64(0)
+	for _, kLine := range kLines {
+		if earliest == 0 || kLine.Time < earliest {
+			earliest = kLine.Time
+		}
+		if kLine.Time >= from && kLine.Time < to {
+			items = append(items, kLine)
+		}
+	}
+	if earliest > from {
+		fmt.Printf("%s交易对：%s -- %s 断线时间过长，%d 之前的K线需要用 backfill 命令补齐\n", s.name, symbol, period, earliest)
+	}
+
+	if err := c.replaceKLines(s.name, symbol, period, items); err != nil {
+		fmt.Println("补齐K线失败", s.name, symbol, period, err)
+	}
+}
+
+// replaceKLines 按时间 upsert，已有的K线整根覆盖
+func (c *ConCurrentEngine) replaceKLines(name string, pair string, period string, kLines []*KLine) error {
+
+	if len(kLines) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(kLines))
+	for i, kLine := range kLines {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"time": kLine.Time}).
+			SetUpdate(bson.M{"$set": kLine}).
+			SetUpsert(true)
+	}
+
+	_, err := c.KLineCollection(name, pair, period).BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// backfillCheckpoint 分页补数据的进度，before 为已经获取到的最早的K线时间
+type backfillCheckpoint struct {
+	Id        string `bson:"_id"`
+	Before    int64  `bson:"before"`
+	UpdatedAt int64  `bson:"updated_at"`
+}
+
+// BackfillCollection 保存补数据进度的集合
+const BackfillCollection = "backfill_checkpoint"
+
+// backfillEmptyStep 一页没有K线时往前跳过的K线数量，不超过各交易所一页的数量，不会漏掉数据
+const backfillEmptyStep = 300
+
+// Backfill 从当前K线往前分页获取历史K线直到 from 或者交易所没有更早的K线，每秒最多请求 rate 次
+// 中间没有K线的时间段（如暂停交易）跳过继续往前，每页写入后保存进度，中断后再次执行从上次的位置继续
+func (c *ConCurrentEngine) Backfill(name string, symbol string, period string, from int64, rate int) error {
+
+	s := c.source(name)
+	if s == nil {
+		return fmt.Errorf("数据源不存在: %s", name)
+	}
+	if !s.hasPeriod(period) {
+		return fmt.Errorf("数据源 %s 没有同步周期 %s", name, period)
+	}
+	if rate <= 0 {
+		rate = 1
+	}
+
+	checkpoints := c.Db.Collection(BackfillCollection)
+	id := name + "_" + klineGetCollectionName(symbol, period)
+
+	before, _ := klineCreateDateTime(time.Now().Unix(), period, 1, s.location)
+	var checkpoint backfillCheckpoint
+	err := checkpoints.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&checkpoint)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		before = checkpoint.Before
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	for before > from {
+		<-ticker.C
+
+		kLines, err := s.worker.HistoryKlineBefore(symbol, period, before)
+		if errors.Is(err, ErrHistoryStart) {
+			fmt.Printf("%s交易对：%s -- %s 没有 %d 之前的K线\n", name, symbol, period, before)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		earliest := before
+		var items []*KLine
+		for _, kLine := range kLines {
+			if kLine.Time >= before || kLine.Time < from {
+				continue
+			}
+			items = append(items, kLine)
+			if kLine.Time < earliest {
+				earliest = kLine.Time
+			}
+		}
+		if len(items) == 0 && len(kLines) > 0 {
+			// 返回的都在 from 之前
+			earliest = from
+		} else if len(items) == 0 {
+			// 这一段时间没有K线，继续往前
+			p, _ := parsePeriod(period)
+			earliest = before - p.maxSeconds()*backfillEmptyStep
+		} else if err := c.replaceKLines(name, symbol, period, items); err != nil {
+			return err
+		}
+
+		before = earliest
+		_, err = checkpoints.UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{
+			"$set": bson.M{"before": before, "updated_at": time.Now().Unix()},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s交易对：%s -- %s 已获取到 %s\n", name, symbol, period, time.Unix(before, 0).In(s.location).Format("2006-01-02 15:04:05"))
+	}
+
+	return nil
+}
+
+// ParseDate 按引擎时区解析日期，如 2020-01-01
+func (c *ConCurrentEngine) ParseDate(date string) (int64, error) {
+	t, err := time.ParseInLocation("2006-01-02", date, c.location)
+	if err != nil {
+		return 0, fmt.Errorf("日期有误: %s %v", date, err)
+	}
+	return t.Unix(), nil
+}
+
+// lastKLineTime 数据库中最后一根K线的时间，没有数据返回 0
+func (c *ConCurrentEngine) lastKLineTime(name string, pair string, period string) (int64, error) {
+
+	var kLine KLine
+	err := c.KLineCollection(name, pair, period).FindOne(context.TODO(), bson.M{}, options.FindOne().SetSort(bson.M{"time": -1})).Decode(&kLine)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return kLine.Time, nil
+}
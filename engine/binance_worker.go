@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync-kline/client"
+	"sync-kline/config"
+	"time"
+)
+
+type BinanceWorker struct {
+	workerBase
+	httpClient *client.Client
+}
+
+// BinanceWsMessageRes 推送的字段区分大小写（e/E、t/T），需要都声明出来，否则会被 json 忽略大小写匹配到错误的字段
+type BinanceWsMessageRes struct {
+	Id        int64           `json:"id"`
+	Result    json.RawMessage `json:"result"`
+	Event     string          `json:"e"`
+	EventTime int64           `json:"E"`
+}
+
+// BinanceTradeRes m 是买方是否挂单方，M 没有用到也要声明，否则会覆盖 m
+type BinanceTradeRes struct {
+	Event        string `json:"e"`
+	EventTime    int64  `json:"E"`
+	Symbol       string `json:"s"`
+	TradeId      int64  `json:"t"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	TradeTime    int64  `json:"T"`
+	IsBuyerMaker bool   `json:"m"`
+	Ignore       bool   `json:"M"`
+}
+
+var binancePeriodMap = map[string]string{
+	"1min":  "1m",
+	"5min":  "5m",
+	"15min": "15m",
+	"30min": "30m",
+	"1hour": "1h",
+	"4hour": "4h",
+	"1day":  "1d",
+	"1week": "1w",
+	"1mon":  "1M",
+}
+
+func (w *BinanceWorker) readMessage(message []byte) {
+
+	var res BinanceWsMessageRes
+	err := json.Unmarshal(message, &res)
+	if err != nil {
+		return
+	}
+
+	if res.Event == "trade" {
+		w.formatTradeDetail(message)
+	}
+}
+
+func (w *BinanceWorker) formatTradeDetail(message []byte) {
+
+	var trade BinanceTradeRes
+	if err := json.Unmarshal(message, &trade); err != nil {
+		w.decodeError(err)
+		return
+	}
+
+	price, err := decimal.NewFromString(trade.Price)
+	if err != nil {
+		return
+	}
+	amount, err := decimal.NewFromString(trade.Quantity)
+	if err != nil {
+		return
+	}
+
+	w.emit(&TradeDetailCh{
+		Symbol:  strings.ToLower(trade.Symbol),
+		Time:    trade.TradeTime / 1000,
+		Amount:  amount,
+		Price:   price,
+		TradeId: trade.TradeId,
+		Side:    binanceSide(trade.IsBuyerMaker),
+	})
+}
+
+// binanceSide 买方是挂单方时主动成交的是卖方
+func binanceSide(isBuyerMaker bool) string {
+	if isBuyerMaker {
+		return SideSell
+	}
+	return SideBuy
+}
+
+// binanceSubscribeMsg 订阅成交的消息
+func binanceSubscribeMsg(symbol string) ([]byte, error) {
+
+	req := make(map[string]interface{})
+	req["method"] = "SUBSCRIBE"
+	req["params"] = []string{fmt.Sprintf("%s@trade", strings.ToLower(symbol))}
+	req["id"] = time.Now().UnixNano()
+
+	return json.Marshal(req)
+}
+
+func (w *BinanceWorker) HistoryKline(symbol string, period string) ([]*KLine, error) {
+	return w.klines(symbol, period, 0)
+}
+
+// HistoryKlineBefore before 之前的 1000 根K线，返回的是最近的K线，没有数据说明已经到了上线时间
+func (w *BinanceWorker) HistoryKlineBefore(symbol string, period string, before int64) ([]*KLine, error) {
+	kLines, err := w.klines(symbol, period, before*1000-1)
+	if err == nil && len(kLines) == 0 {
+		return nil, fmt.Errorf("binance %w: %s %d", ErrHistoryStart, symbol, before)
+	}
+	return kLines, err
+}
+
+// klines endTime 为 0 时取最近的K线
+func (w *BinanceWorker) klines(symbol string, period string, endTime int64) ([]*KLine, error) {
+
+	standard, _ := standardPeriod(period)
+	interval, ok := binancePeriodMap[standard]
+	if !ok {
+		return nil, fmt.Errorf("binance %w: %s", ErrPeriodNotSupported, period)
+	}
+
+	params := url.Values{}
+	params["symbol"] = []string{strings.ToUpper(symbol)}
+	params["interval"] = []string{interval}
+	params["limit"] = []string{"1000"}
+	if endTime > 0 {
+		params["endTime"] = []string{strconv.FormatInt(endTime, 10)}
+	}
+
+	path := "/api/v3/klines"
+
+	// [开盘时间, 开盘价, 最高价, 最低价, 收盘价, 成交量, 收盘时间, 成交额, 成交笔数, 主动买入成交量, 主动买入成交额, 忽略]
+	var res [][]interface{}
+
+	err := w.httpClient.Get(path, params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var klines []*KLine
+	for _, item := range res {
+		if len(item) < 9 {
+			continue
+		}
+		openTime, _ := item[0].(float64)
+		count, _ := item[8].(float64)
+		amount := binanceDecimal(item[5])
+		var buyAmount, buyVol decimal.Decimal
+		if len(item) >= 11 {
+			buyAmount = binanceDecimal(item[9])
+			buyVol = binanceDecimal(item[10])
+		}
+		klines = append(klines, &KLine{
+			Time:   int64(openTime) / 1000,
+			Open:   toDecimal128(binanceDecimal(item[1])),
+			High:   toDecimal128(binanceDecimal(item[2])),
+			Low:    toDecimal128(binanceDecimal(item[3])),
+			Close:  toDecimal128(binanceDecimal(item[4])),
+			Amount: toDecimal128(amount),
+			Vol:    toDecimal128(binanceDecimal(item[7])),
+			Count:  int(count),
+
+			BuyAmount:  toDecimal128(buyAmount),
+			SellAmount: toDecimal128(amount.Sub(buyAmount)),
+			BuyVol:     toDecimal128(buyVol),
+		})
+	}
+
+	return klines, nil
+}
+
+// binanceDecimal 价格数量都是字符串
+func binanceDecimal(v interface{}) decimal.Decimal {
+	s, _ := v.(string)
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal0
+	}
+	return d
+}
+
+func NewBinanceWorker(config *config.SourceConfig, queueConfig *config.QueueConfig) (*BinanceWorker, error) {
+
+	queue, err := newTradeQueue(sourceName(config), queueConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy func(r *http.Request) (*url.URL, error)
+	if len(config.ProxyUrl) > 0 {
+		uProxy, _ := url.Parse(config.ProxyUrl)
+		proxy = http.ProxyURL(uProxy)
+	}
+
+	conn := newWsConn(config.WsUrl, proxy)
+
+	httpClient := client.NewClient(config.HttpUrl, proxy)
+
+	w := &BinanceWorker{
+		workerBase: newWorkerBase("binance", conn, config.Symbols, queue),
+		httpClient: httpClient,
+	}
+	w.subscribeMsg = binanceSubscribeMsg
+	w.init(w.readMessage)
+
+	return w, nil
+}
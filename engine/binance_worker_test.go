@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync-kline/config"
+	"testing"
+	"time"
+)
+
+func newTestBinanceWorker(t *testing.T, httpUrl string) *BinanceWorker {
+	t.Helper()
+	w, err := NewBinanceWorker(&config.SourceConfig{
+		Platform: "binance",
+		HttpUrl:  httpUrl,
+		Symbols:  []string{"btcusdt"},
+	}, &config.QueueConfig{Size: 10, Overflow: OverflowDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// popTrades 关闭队列后取出全部成交
+func popTrades(w *BinanceWorker) []*TradeDetailCh {
+	w.queue.close()
+	var trades []*TradeDetailCh
+	for {
+		trade, ok := w.queue.pop()
+		if !ok {
+			return trades
+		}
+		trades = append(trades, trade)
+	}
+}
+
+func TestBinanceReadMessage(t *testing.T) {
+	w := newTestBinanceWorker(t, "")
+
+	messages := []string{
+		// 订阅的回复
+		`{"result":null,"id":1}`,
+		// 买方是挂单方，主动成交的是卖方
+		`{"e":"trade","E":1700000000123,"s":"BTCUSDT","t":12345,"p":"37000.10","q":"0.002","T":1700000000100,"m":true,"M":true}`,
+		`{"e":"trade","E":1700000001123,"s":"BTCUSDT","t":12346,"p":"37000.20","q":"1.5","T":1700000001999,"m":false,"M":true}`,
+		// 其它事件
+		`{"e":"aggTrade","E":1700000002000,"s":"BTCUSDT","a":1,"p":"1","q":"1","T":1700000002000,"m":true}`,
+		`not json`,
+	}
+	for _, message := range messages {
+		w.readMessage([]byte(message))
+	}
+
+	trades := popTrades(w)
+	if len(trades) != 2 {
+		t.Fatalf("got %d trades, want 2", len(trades))
+	}
+
+	want := []struct {
+		time   int64
+		id     int64
+		price  string
+		amount string
+		side   string
+	}{
+		{1700000000, 12345, "37000.1", "0.002", SideSell},
+		{1700000001, 12346, "37000.2", "1.5", SideBuy},
+	}
+	for i, trade := range trades {
+		if trade.Symbol != "btcusdt" {
+			t.Errorf("trade %d symbol = %s", i, trade.Symbol)
+		}
+		if trade.Time != want[i].time {
+			t.Errorf("trade %d time = %d, want %d", i, trade.Time, want[i].time)
+		}
+		if trade.TradeId != want[i].id {
+			t.Errorf("trade %d id = %d, want %d", i, trade.TradeId, want[i].id)
+		}
+		if trade.Price.String() != want[i].price || trade.Amount.String() != want[i].amount {
+			t.Errorf("trade %d = %s x %s, want %s x %s", i, trade.Price, trade.Amount, want[i].price, want[i].amount)
+		}
+		if trade.Side != want[i].side {
+			t.Errorf("trade %d side = %s, want %s", i, trade.Side, want[i].side)
+		}
+	}
+
+	select {
+	case err := <-w.Errors():
+		t.Fatalf("unexpected error %v", err)
+	default:
+	}
+}
+
+// 连接本地的 websocket 服务，订阅后从 Trades 读取成交
+func TestBinanceWorkerStart(t *testing.T) {
+	subs := make(chan []byte, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		subs <- message
+
+		var req struct {
+			Id int64 `json:"id"`
+		}
+		_ = json.Unmarshal(message, &req)
+		replies := []string{
+			`{"result":null,"id":` + strconv.FormatInt(req.Id, 10) + `}`,
+			`{"e":"trade","E":1700000000123,"s":"BTCUSDT","t":12345,"p":"37000.10","q":"0.002","T":1700000000100,"m":true,"M":true}`,
+			`{"e":"trade","E":1700000001123,"s":"BTCUSDT","t":12346,"p":"37000.20","q":"1.5","T":1700000001999,"m":false,"M":true}`,
+		}
+		for _, reply := range replies {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	w, err := NewBinanceWorker(&config.SourceConfig{
+		Platform: "binance",
+		WsUrl:    wsTestUrl(server),
+		Symbols:  []string{"BTCUSDT"},
+	}, &config.QueueConfig{Size: 10, Overflow: OverflowDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	select {
+	case message := <-subs:
+		var req struct {
+			Method string   `json:"method"`
+			Params []string `json:"params"`
+			Id     int64    `json:"id"`
+		}
+		if err := json.Unmarshal(message, &req); err != nil {
+			t.Fatalf("subscribe %s: %v", message, err)
+		}
+		if req.Method != "SUBSCRIBE" || len(req.Params) != 1 || req.Params[0] != "btcusdt@trade" || req.Id == 0 {
+			t.Fatalf("subscribe = %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscribe not sent")
+	}
+
+	want := []struct {
+		id   int64
+		side string
+	}{
+		{12345, SideSell},
+		{12346, SideBuy},
+	}
+	for _, item := range want {
+		select {
+		case trade := <-w.Trades():
+			if trade.Symbol != "btcusdt" || trade.TradeId != item.id || trade.Side != item.side {
+				t.Fatalf("trade = %+v, want %d %s", trade, item.id, item.side)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("trade %d not received", item.id)
+		}
+	}
+	if w.State() != ConnConnected {
+		t.Fatalf("State() = %s, want %s", w.State(), ConnConnected)
+	}
+
+	// 关闭后 Trades 关闭
+	_ = w.Close()
+	select {
+	case _, ok := <-w.Trades():
+		if ok {
+			t.Fatal("unexpected trade after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Trades not closed after Close")
+	}
+}
+
+// 字段类型不对时报告解析错误，不放入队列
+func TestBinanceReadMessageDecodeError(t *testing.T) {
+	w := newTestBinanceWorker(t, "")
+
+	w.readMessage([]byte(`{"e":"trade","E":1700000000123,"s":"BTCUSDT","t":"12345","p":"1","q":"1","T":1700000000100,"m":true}`))
+
+	if trades := popTrades(w); len(trades) != 0 {
+		t.Fatalf("got %d trades, want 0", len(trades))
+	}
+	select {
+	case err := <-w.Errors():
+		var workerErr *WorkerError
+		if !errors.As(err, &workerErr) || workerErr.Op != OpDecode || workerErr.Platform != "binance" {
+			t.Fatalf("error = %v, want binance decode error", err)
+		}
+	default:
+		t.Fatal("decode error not reported")
+	}
+}
+
+func TestBinanceKlines(t *testing.T) {
+	query := make(chan map[string]string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/klines" {
+			http.NotFound(w, r)
+			return
+		}
+		values := r.URL.Query()
+		query <- map[string]string{
+			"symbol":   values.Get("symbol"),
+			"interval": values.Get("interval"),
+			"limit":    values.Get("limit"),
+			"endTime":  values.Get("endTime"),
+		}
+		if values.Get("endTime") == "1699999199999" {
+			// 上线之前没有数据
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[
+			[1700000000000,"37000.00","37100.00","36900.00","37050.00","12.5",1700003599999,"462500.00",321,"7.5","277500.00","0"],
+			[1700003600000,"37050.00","37060.00","37000.00","37010.00","2",1700007199999,"74060.00",40,"0.5","18520.00","0"],
+			[1700007200000,"1"]
+		]`))
+	}))
+	defer server.Close()
+
+	w := newTestBinanceWorker(t, server.URL)
+
+	kLines, err := w.HistoryKline("btcusdt", "1hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := <-query
+	if q["symbol"] != "BTCUSDT" || q["interval"] != "1h" || q["limit"] != "1000" || q["endTime"] != "" {
+		t.Fatalf("query = %v", q)
+	}
+	// 字段不完整的跳过
+	if len(kLines) != 2 {
+		t.Fatalf("got %d klines, want 2", len(kLines))
+	}
+
+	k := kLines[0]
+	if k.Time != 1700000000 || k.Count != 321 {
+		t.Errorf("time = %d count = %d", k.Time, k.Count)
+	}
+	fields := []struct {
+		name string
+		got  primitive.Decimal128
+		want string
+	}{
+		{"open", k.Open, "37000"},
+		{"high", k.High, "37100"},
+		{"low", k.Low, "36900"},
+		{"close", k.Close, "37050"},
+		{"amount", k.Amount, "12.5"},
+		{"vol", k.Vol, "462500"},
+		{"buy_amount", k.BuyAmount, "7.5"},
+		{"sell_amount", k.SellAmount, "5"},
+		{"buy_vol", k.BuyVol, "277500"},
+	}
+	for _, field := range fields {
+		if got := fromDecimal128(field.got).String(); got != field.want {
+			t.Errorf("%s = %s, want %s", field.name, got, field.want)
+		}
+	}
+	if got := fromDecimal128(kLines[1].SellAmount).String(); got != "1.5" {
+		t.Errorf("second sell_amount = %s, want 1.5", got)
+	}
+
+	if _, err := w.HistoryKlineBefore("btcusdt", "1day", 1700000000); err != nil {
+		t.Fatal(err)
+	}
+	if q := <-query; q["interval"] != "1d" || q["endTime"] != "1699999999999" {
+		t.Fatalf("query = %v", q)
+	}
+
+	_, err = w.HistoryKlineBefore("btcusdt", "1hour", 1699999200)
+	if !errors.Is(err, ErrHistoryStart) {
+		t.Fatalf("empty page error = %v, want ErrHistoryStart", err)
+	}
+	<-query
+
+	if _, err := w.HistoryKline("btcusdt", "3min"); !errors.Is(err, ErrPeriodNotSupported) {
+		t.Fatalf("3min error = %v, want ErrPeriodNotSupported", err)
+	}
+	select {
+	case q := <-query:
+		t.Fatalf("unsupported period requested %v", q)
+	default:
+	}
+}
@@ -7,48 +7,89 @@ import (
 	"fmt"
 	"github.com/shopspring/decimal"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 	"sync-kline/config"
 	"time"
 )
 
-type Worker interface {
-	Close() error
-	Start()
-	WriteMessage(msg []byte)
-	SubscribeTradeDetail(symbol string)
-	HistoryKline(symbol string, period string) ([]*KLine, error)
-	ReadTradeDetailCh() *TradeDetailCh
-}
-
+// KLine 价格数量用 Decimal128 存储，json 输出仍然是字符串
 type KLine struct {
-	Time   int64  `json:"time"`   // 时间
-	Open   string `json:"open"`   // 开盘
-	Close  string `json:"close"`  // 收盘
-	Low    string `json:"low"`    // 最低
-	High   string `json:"high"`   // 最高
-	Amount string `json:"amount"` // 数量
-	Vol    string `json:"vol"`    // 成交额
-	Count  int    `json:"count"`  // 成交数量
+	Time       int64                `json:"time"`                // 时间
+	Open       primitive.Decimal128 `json:"open"`                // 开盘
+	Close      primitive.Decimal128 `json:"close"`               // 收盘
+	Low        primitive.Decimal128 `json:"low"`                 // 最低
+	High       primitive.Decimal128 `json:"high"`                // 最高
+	Amount     primitive.Decimal128 `json:"amount"`              // 数量
+	Vol        primitive.Decimal128 `json:"vol"`                 // 成交额
+	Count      int                  `json:"count"`               // 成交数量
+	BuyAmount  primitive.Decimal128 `json:"buy_amount"`          // 主动买入数量
+	SellAmount primitive.Decimal128 `json:"sell_amount"`         // 主动卖出数量
+	BuyVol     primitive.Decimal128 `json:"buy_vol"`             // 主动买入成交额
+	WalSeq     uint64               `json:"-" bson:",omitempty"` // 已经写入的 wal 中最大的成交序号，重新聚合时跳过
 }
 
+const (
+	SideBuy  = "buy"  // 主动买入
+	SideSell = "sell" // 主动卖出
+)
+
 type TradeDetailCh struct {
-	Symbol string
-	Time   int64
-	Amount decimal.Decimal
-	Price  decimal.Decimal
+	Symbol  string
+	Time    int64
+	Amount  decimal.Decimal
+	Price   decimal.Decimal
+	TradeId int64  // 成交 ID，同一个交易对递增
+	Side    string // 主动成交方向 buy/sell，为空表示未知
+}
+
+// source 数据源，每个数据源一个 worker，K线写入各自的命名空间
+type source struct {
+	name       string
+	config     *config.SourceConfig
+	worker     Worker
+	periods    []string               // 同步的标准周期
+	location   *time.Location         // K线切分的时区
+	backfillMu sync.Mutex             // 同一个数据源的补数据串行执行
+	repairs    map[string]*time.Timer // 每个交易对周期等待中的修复，由 backfillMu 保护
 }
 
 type ConCurrentEngine struct {
-	worker Worker
-	Db     *mongo.Database
-	config *config.EngineConfig
+	sources       []*source
+	Db            *mongo.Database
+	namespace     string
+	config        *config.EngineConfig
+	sinks         []Sink
+	aggregator    *aggregator
+	dedup         *tradeDedup
+	flushMu       sync.Mutex
+	rollupMu      sync.Mutex
+	rollups       map[rollupKey]*rollupCandle // rollup 模式下高周期还没收盘的K线
+	location      *time.Location
+	flushInterval time.Duration
+	closeDelay    time.Duration
+	aggregation   string
+	done          chan struct{}
+	wg            sync.WaitGroup
+	loops         sync.WaitGroup // 读取成交的协程
+	shards        []*shard
+	shardWg       sync.WaitGroup
+	wal           *tradeWal // 没有开启时为 nil
+	closeOnce     sync.Once
 }
 
+const (
+	NamespaceCollection = "collection" // 集合名加数据源前缀
+	NamespaceDatabase   = "database"   // 每个数据源单独的库
+)
+
 var (
+	// periodMap 周期别名，其它周期按 parsePeriod 解析
 	periodMap = map[string]string{
 		"1min":  "1min",
 		"5min":  "5min",
@@ -71,57 +112,146 @@ var (
 		"1M":    "1mon",
 		"1w":    "1week",
 	}
-	timeMap = map[string]int64{
-		"1min":  60,
-		"5min":  5 * 60,
-		"15min": 15 * 60,
-		"30min": 30 * 60,
-		"1hour": 60 * 60,
-		"4hour": 4 * 60 * 60,
-		"1day":  24 * 60 * 60,
-		"1week": 7 * 24 * 60 * 60,
-		"1mon":  0,
-		"1year": 0,
-	}
-	timeSubMap = map[string]int64{
-		"1day":  -8 * 60 * 60,         // 一天的零点需要减去8小时，因为时间戳从8点开始算的
-		"1week": 4*24*60*60 - 8*60*60, // 每周的周一需要加上 4天，去掉8小时，因为时间戳是从周四开始的
+	// periodOrder 标准周期从低到高
+	periodOrder = []string{"1min", "5min", "15min", "30min", "1hour", "4hour", "1day", "1week", "1mon", "1year"}
+	// platformTimezone 交易所历史K线切分的时区，数据源没有配置时使用，其它平台使用引擎的时区
+	platformTimezone = map[string]string{
+		"binance": "UTC",
 	}
 )
 
 var decimal0 = decimal.NewFromInt(0)
 
-// Start 启动
-func (c *ConCurrentEngine) Start() {
+// Start 启动，连接失败返回错误；ctx 取消后停止采集，处理完已经收到的成交并把K线写入后返回
+func (c *ConCurrentEngine) Start(ctx context.Context) error {
+
+	if c.config.Wal.Enable {
+		wal, err := openWal(c.config.Wal.Dir, c.config.Wal.SegmentSize)
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("打开 wal 失败: %w", err)
+		}
+		c.wal = wal
+		c.aggregator.wal = wal
+	}
+
+	c.wg.Add(1)
+	go c.flushLoop()
+
+	for _, sh := range c.shards {
+		c.shardWg.Add(1)
+		go c.runShard(sh)
+	}
+
+	// 先重新聚合上次没有写入的成交，再接收新的成交
+	if c.wal != nil {
+		if err := c.replayWal(); err != nil {
+			c.Close()
+			return fmt.Errorf("重新聚合 wal 失败: %w", err)
+		}
+	}
+
+	for _, s := range c.sources {
+		if err := s.worker.Start(ctx); err != nil {
+			c.Close()
+			return fmt.Errorf("%s 启动失败: %w", s.name, err)
+		}
+	}
+
+	for _, s := range c.sources {
+		c.loops.Add(1)
+		go c.loop(s)
+	}
+
+	<-ctx.Done()
+	c.Close()
+	return nil
+}
+
+// Close 关闭所有数据源，处理完已经收到的成交，并把内存中的K线全部写入
+func (c *ConCurrentEngine) Close() {
+	c.closeOnce.Do(func() {
+		for _, s := range c.sources {
+			if s.worker == nil {
+				continue
+			}
+			if err := s.worker.Close(); err != nil {
+				fmt.Println(s.name, "关闭失败", err)
+			}
+		}
+		c.loops.Wait()
 
-	defer c.worker.Close()
+		// 分片处理完队列中的成交
+		for _, sh := range c.shards {
+			sh.close()
+		}
+		c.shardWg.Wait()
 
-	go c.loop()
+		close(c.done)
+		c.wg.Wait()
+		c.flush()
+		c.closeCandles()
 
-	select {}
+		if c.wal != nil {
+			if err := c.wal.close(); err != nil {
+				fmt.Println("关闭 wal 失败", err)
+			}
+		}
+	})
 }
 
-// loop 循环监听
-func (c *ConCurrentEngine) loop() {
+// loop 循环监听，按交易对分到各个分片聚合，分片满时等待，连接关闭后返回
+func (c *ConCurrentEngine) loop(s *source) {
+
+	defer c.loops.Done()
 
-	go c.worker.Start()
+	trades := s.worker.Trades()
+	errs := s.worker.Errors()
 
 	// 循环读取
 	for {
-		tradeDetailCh := c.worker.ReadTradeDetailCh()
+		var tradeDetailCh *TradeDetailCh
+		select {
+		case err := <-errs:
+			fmt.Println(s.name, err)
+			continue
+		case item, ok := <-trades:
+			if !ok {
+				return
+			}
+			tradeDetailCh = item
+		}
 
-		for period := range timeMap {
-			c.KLineCreate("", tradeDetailCh.Symbol, tradeDetailCh.Time, period, tradeDetailCh.Price, tradeDetailCh.Amount)
+		// 重新订阅后交易所可能重复推送
+		if c.dedup.seen(s.name, tradeDetailCh.Symbol, tradeDetailCh.TradeId) {
+			continue
 		}
 
+		// 先写入 wal，数据库写入失败或者进程退出后可以重新聚合
+		var seq uint64
+		if c.wal != nil {
+			var err error
+			seq, err = c.wal.append(s.name, tradeDetailCh)
+			if err != nil {
+				fmt.Println("写入 wal 失败", s.name, err)
+			}
+		}
+
+		// 分片满时等待，成交留在 worker 的队列中；没有放入的不记录，wal 中的下次启动重新聚合
+		if !c.dispatch(s, tradeDetailCh, seq) {
+			fmt.Println("分片已经关闭，成交没有聚合", s.name, tradeDetailCh.Symbol, tradeDetailCh.TradeId)
+			continue
+		}
+		c.dedup.record(s.name, tradeDetailCh.Symbol, tradeDetailCh.TradeId)
+
 		//fmt.Println("推送", tradeDetailCh)
 	}
 
 }
 
-func (c *ConCurrentEngine) saveHistory(symbol string, period string) {
+func (c *ConCurrentEngine) saveHistory(s *source, symbol string, period string) {
 
-	kLines, err := c.worker.HistoryKline(symbol, period)
+	kLines, err := s.worker.HistoryKline(symbol, period)
 	if err != nil {
 		return
 	}
@@ -130,127 +260,298 @@ func (c *ConCurrentEngine) saveHistory(symbol string, period string) {
 	for i, kLine := range kLines {
 		data[i] = kLine
 	}
-	_, err = c.Db.Collection(klineGetCollectionName(symbol, period)).InsertMany(context.TODO(), data)
-	if err != nil {
+	// 已经存在的K线会因为唯一索引插入失败，跳过即可
+	_, err = c.KLineCollection(s.name, symbol, period).InsertMany(context.TODO(), data, options.InsertMany().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
 		fmt.Println(err)
 		return
 	}
 }
 
+// KLineDatabase 数据源对应的数据库，按库隔离时每个数据源一个库，如 trade_huobi
 func (c *ConCurrentEngine) KLineDatabase(name string) *mongo.Database {
 
-	return c.Db
+	if name == "" || c.namespace != NamespaceDatabase {
+		return c.Db
+	}
+
+	return c.Db.Client().Database(c.Db.Name() + "_" + name)
 }
 
-func (c *ConCurrentEngine) KLineCreateAll(name string, pair string, ts int64, price decimal.Decimal, amount decimal.Decimal) {
+// KLineCollection 数据源交易对周期对应的集合，按集合隔离时加上数据源前缀，如 huobi_btcusdt_1min
+func (c *ConCurrentEngine) KLineCollection(name string, pair string, period string) *mongo.Collection {
 
-	for period := range timeMap {
-		c.KLineCreate(name, pair, ts, period, price, amount)
+	collectionName := klineGetCollectionName(pair, period)
+	if name != "" && c.namespace == NamespaceCollection {
+		collectionName = name + "_" + collectionName
 	}
 
+	return c.KLineDatabase(name).Collection(collectionName)
 }
 
-func (c *ConCurrentEngine) KLineCreate(name string, pair string, ts int64, period string, price decimal.Decimal, amount decimal.Decimal) {
+func (c *ConCurrentEngine) KLineCreateAll(name string, pair string, ts int64, price decimal.Decimal, amount decimal.Decimal, side string) {
 
-	currentTime, _ := klineCreateDateTime(ts, periodMap[period], 0, 1)
+	s := c.source(name)
+	if s == nil {
+		return
+	}
 
-	filter := bson.M{"time": currentTime}
-	isAdd := false
-	findOne := c.KLineDatabase(name).Collection(klineGetCollectionName(pair, period)).FindOne(context.TODO(), filter)
-	var kLine KLine
-	if findOne.Err() != nil {
-		isAdd = true
-		kLine = KLine{
-			Time:   0,
-			Open:   decimal0.String(),
-			Close:  decimal0.String(),
-			Low:    decimal0.String(),
-			High:   decimal0.String(),
-			Amount: decimal0.String(),
-			Vol:    decimal0.String(),
-			Count:  0,
+	c.applyTrade(name, &TradeDetailCh{Symbol: pair, Time: ts, Price: price, Amount: amount, Side: side}, c.tradePeriods(s), 0)
+
+}
+
+// tradePeriods 由成交直接计算的周期，rollup 模式下只有 1min
+func (c *ConCurrentEngine) tradePeriods(s *source) []string {
+	if c.aggregation == AggregationRollup {
+		return []string{rollupBase}
+	}
+	return s.periods
+}
+
+// KLineCreate 成交合并到内存中的K线，由 flushLoop 批量写入
+func (c *ConCurrentEngine) KLineCreate(name string, pair string, ts int64, period string, price decimal.Decimal, amount decimal.Decimal, side string) {
+	c.applyTrade(name, &TradeDetailCh{Symbol: pair, Time: ts, Price: price, Amount: amount, Side: side}, []string{period}, 0)
+}
+
+// applyTrade 成交合并到各个周期的K线，所有周期、成交 ID 和 wal 序号一起记录，由 flushLoop 批量写入
+func (c *ConCurrentEngine) applyTrade(name string, trade *TradeDetailCh, periods []string, seq uint64) {
+
+	symbol := normalizeSymbol(trade.Symbol)
+	loc := c.sourceLocation(name)
+	updates := make([]candleUpdate, 0, len(periods))
+	for _, period := range periods {
+		period, ok := standardPeriod(period)
+		if !ok {
+			continue
 		}
-	} else {
-		err := findOne.Decode(&kLine)
-		if err != nil {
-			return
+		currentTime, nextTime := klineCreateDateTime(trade.Time, period, -1, loc)
+		u := candleUpdate{key: seriesKey{name: name, symbol: symbol, period: period}, ts: currentTime, end: nextTime}
+
+		// 不在内存中的K线先从数据库取已有的数据
+		if !c.aggregator.has(u.key, currentTime) {
+			var err error
+			u.seed, err = c.findKLine(u.key, currentTime)
+			if err != nil {
+				fmt.Println("查询K线失败", err)
+			}
 		}
+		updates = append(updates, u)
 	}
 
-	kLine.Time = currentTime
-	open, _ := decimal.NewFromString(kLine.Open)
-	if open.Cmp(decimal0) <= 0 {
-		kLine.Open = price.String()
+	kLines := c.aggregator.apply(updates, dedupKey{name: name, symbol: symbol}, trade.TradeId, seq, trade.Price, trade.Amount, trade.Side)
+
+	for i, u := range updates {
+		c.emitCandleUpdate(name, symbol, u.key.period, &kLines[i])
+
+		// rollup 模式下高周期在 1min 收盘后才写入，推送时先从内存合并
+		if c.aggregation == AggregationRollup && u.key.period == rollupBase {
+			if s := c.source(name); s != nil {
+				c.rollupUpdate(s, symbol, u.ts)
+			}
+		}
 	}
-	kLine.Close = price.String()
-	low, _ := decimal.NewFromString(kLine.Low)
-	if low.Cmp(decimal0) <= 0 {
-		kLine.Low = price.String()
-	} else {
-		kLine.Low = decimal.Min(low, price).String()
+
+}
+
+func (c *ConCurrentEngine) findKLine(key seriesKey, ts int64) (*KLine, error) {
+
+	var kLine KLine
+	err := c.KLineCollection(key.name, key.symbol, key.period).FindOne(context.TODO(), bson.M{"time": ts}).Decode(&kLine)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
 	}
-	high, _ := decimal.NewFromString(kLine.High)
-	if high.Cmp(decimal0) <= 0 {
-		kLine.High = price.String()
-	} else {
-		kLine.High = decimal.Max(high, price).String()
+	if err != nil {
+		return nil, err
 	}
+	return &kLine, nil
+}
 
-	amountOld, _ := decimal.NewFromString(kLine.Amount)
-	volOld, _ := decimal.NewFromString(kLine.Vol)
-	kLine.Amount = amountOld.Add(amount).String()
-	kLine.Vol = volOld.Add(amount.Mul(price)).String()
-	kLine.Count += 1
+// flushLoop 定时把内存中有变动的K线写入数据库，K线收盘时立即写入并通知收盘
+func (c *ConCurrentEngine) flushLoop() {
 
-	if isAdd {
-		_, err := c.KLineDatabase(name).Collection(klineGetCollectionName(pair, period)).InsertOne(context.TODO(), kLine)
-		if err != nil {
-			fmt.Println(err)
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	// 没有成交时按时间收盘
+	closeTicker := time.NewTicker(time.Second)
+	defer closeTicker.Stop()
+
+	for {
+		select {
+		case <-c.done:
 			return
+		case <-ticker.C:
+		case <-c.aggregator.flushCh:
+		case now := <-closeTicker.C:
+			if c.aggregator.expire(now.Add(-c.closeDelay).Unix()) == 0 {
+				if c.aggregation == AggregationRollup {
+					c.closeRollups(now.Add(-c.closeDelay).Unix())
+				}
+				continue
+			}
 		}
-	} else {
-		update := bson.M{"$set": kLine}
-		_, err := c.KLineDatabase(name).Collection(klineGetCollectionName(pair, period)).UpdateOne(context.TODO(), filter, update)
+		c.flush()
+		c.closeCandles()
+	}
+}
+
+// closeCandles 通知收盘，rollup 模式下 1min 收盘后合并出高周期，到时间的高周期收盘
+// 和 flush 互斥，收盘的K线移出内存时不会有写入中的增量，写入失败的增量总能放回
+func (c *ConCurrentEngine) closeCandles() {
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	for _, item := range c.aggregator.takeClosed() {
+		c.emitCandleClose(item.key.name, item.key.symbol, item.key.period, &item.kLine)
+
+		if c.aggregation == AggregationRollup && item.key.period == rollupBase {
+			c.rollup(c.source(item.key.name), item.key.symbol, item.kLine.Time, true)
+		}
+	}
+	if c.aggregation == AggregationRollup {
+		c.closeRollupsLocked(time.Now().Add(-c.closeDelay).Unix())
+	}
+}
+
+// flush 按集合批量原子 upsert 增量，写入失败的增量放回内存下次重试
+// 全部写入成功后保存最大成交 ID 和 wal checkpoint，重启后不会重复计算；
+// 部分失败时已经写入的K线记录了 wal 序号，重新聚合时跳过
+func (c *ConCurrentEngine) flush() {
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	if c.wal != nil {
+		if err := c.wal.sync(); err != nil {
+			fmt.Println("wal 写入磁盘失败", err)
+		}
+	}
+
+	// 成交 ID、wal 序号和增量一起取出，保存的 ID 和 checkpoint 对应的成交一定已经写入
+	batch := c.aggregator.take()
+	failed := false
+
+	for key, items := range batch.kLines {
+		models := make([]mongo.WriteModel, len(items))
+		for i, item := range items {
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"time": item.time}).
+				SetUpdate(item.delta.update()).
+				SetUpsert(true)
+		}
+		_, err := c.KLineCollection(key.name, key.symbol, key.period).BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Println("写入K线失败", key.name, key.symbol, key.period, err)
+			c.aggregator.restore(key, items)
+			failed = true
+			continue
+		}
+		late := c.aggregator.markFlushed(key, items)
+
+		// 收盘后迟到的成交写入后重新合并高周期
+		if c.aggregation == AggregationRollup && key.period == rollupBase {
+			for _, ts := range late {
+				c.rollup(c.source(key.name), key.symbol, ts, false)
+			}
 		}
 	}
 
+	if failed {
+		c.aggregator.restoreMarks(batch.marks)
+	} else {
+		if err := c.saveTradeMarks(batch.marks); err != nil {
+			fmt.Println("保存成交 ID 失败", err)
+			c.aggregator.restoreMarks(batch.marks)
+		}
+		if c.wal != nil {
+			if err := c.wal.commit(batch.walMark); err != nil {
+				fmt.Println("保存 wal checkpoint 失败", err)
+			}
+		}
+	}
 }
 
-func (c *ConCurrentEngine) KlinePeriod() []string {
+// ensureIndex 每个周期的集合按时间唯一
+func (c *ConCurrentEngine) ensureIndex(name string, pair string, period string) error {
+
+	_, err := c.KLineCollection(name, pair, period).Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "time", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
 
-	var periods []string
+// checkMigrated 旧版本字符串存储的价格不能和 Decimal128 一起累加，没有转换时不能启动
+// 只检查最早和最新的K线，走时间索引
+func (c *ConCurrentEngine) checkMigrated(name string, pair string, period string) error {
 
-	for period := range timeMap {
-		periods = append(periods, period)
+	collection := c.KLineCollection(name, pair, period)
+	for _, order := range []int{1, -1} {
+		var doc bson.M
+		err := collection.FindOne(context.TODO(), bson.M{}, options.FindOne().SetSort(bson.M{"time": order})).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, field := range migrateFields {
+			if _, ok := migrateValue(doc[field]); ok {
+				return fmt.Errorf("%s 中的价格数量还没有转换成 Decimal128，先执行 migrate", collection.Name())
+			}
+		}
 	}
+	return nil
+}
 
-	return periods
+func (c *ConCurrentEngine) KlinePeriod() []string {
+	return append([]string(nil), periodOrder...)
 }
 
-func (c *ConCurrentEngine) KlineHistory(name string, pair string, period string, lastTime int64) ([]*KLine, error) {
+// Periods 数据源同步的周期
+func (c *ConCurrentEngine) Periods(name string) []string {
+	s := c.source(name)
+	if s == nil {
+		return nil
+	}
+	return s.periods
+}
 
-	var kLines []*KLine
+// HasPeriod 数据源是否在同步该周期
+func (c *ConCurrentEngine) HasPeriod(name string, period string) bool {
+	s := c.source(name)
+	return s != nil && s.hasPeriod(period)
+}
 
-	filter := bson.M{}
+// KlineHistory 查询K线，from/to 为闭区间（0 表示不限制），按时间升序返回最近的 limit 条
+func (c *ConCurrentEngine) KlineHistory(name string, pair string, period string, from int64, to int64, limit int) ([]*KLine, error) {
 
-	if lastTime > 0 {
-		filter = bson.M{"time": bson.M{"$lt": lastTime}}
+	kLines := make([]*KLine, 0)
+
+	timeFilter := bson.M{}
+	if from > 0 {
+		timeFilter["$gte"] = from
+	}
+	if to > 0 {
+		timeFilter["$lte"] = to
+	}
+	filter := bson.M{}
+	if len(timeFilter) > 0 {
+		filter["time"] = timeFilter
 	}
 
-	// 定义分页参数
-	page := 1       // 当前页数
-	pageSize := 200 // 每页条数
-	skip := (page - 1) * pageSize
+	if limit <= 0 {
+		limit = 200
+	}
 
 	findOptions := options.Find()
-	findOptions.SetSkip(int64(skip))
-	findOptions.SetLimit(int64(pageSize))
-	findOptions.SetSort(bson.M{"time": -1}) // 时间降序
+	findOptions.SetLimit(int64(limit))
+	findOptions.SetSort(bson.M{"time": -1}) // 时间降序取最近的数据
 
-	cur, err := c.KLineDatabase(name).Collection(klineGetCollectionName(pair, period)).Find(context.Background(), filter, findOptions)
+	cur, err := c.KLineCollection(name, pair, period).Find(context.Background(), filter, findOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -260,90 +561,355 @@ func (c *ConCurrentEngine) KlineHistory(name string, pair string, period string,
 		return nil, err
 	}
 
+	// 转成时间升序
+	for i, j := 0, len(kLines)-1; i < j; i, j = i+1, j-1 {
+		kLines[i], kLines[j] = kLines[j], kLines[i]
+	}
+
 	return kLines, nil
 }
 
+// SourceStatus 数据源连接状态
+type SourceStatus struct {
+	Name         string     `json:"name"`         // 数据源
+	Platform     string     `json:"platform"`     // 平台
+	State        string     `json:"state"`        // 连接状态
+	Reconnection int        `json:"reconnection"` // 累计重连次数
+	Queue        QueueStats `json:"queue"`        // 推送到引擎之间的队列
+}
+
+// Status 所有数据源的连接状态
+func (c *ConCurrentEngine) Status() []SourceStatus {
+	status := make([]SourceStatus, len(c.sources))
+	for i, s := range c.sources {
+		status[i] = SourceStatus{
+			Name:         s.name,
+			Platform:     s.config.Platform,
+			State:        s.worker.State().String(),
+			Reconnection: s.worker.Reconnection(),
+			Queue:        s.worker.QueueStats(),
+		}
+	}
+	return status
+}
+
+// Sources 所有数据源名称，第一个为默认数据源
+func (c *ConCurrentEngine) Sources() []string {
+	names := make([]string, len(c.sources))
+	for i, s := range c.sources {
+		names[i] = s.name
+	}
+	return names
+}
+
+// HasSource 数据源是否存在
+func (c *ConCurrentEngine) HasSource(name string) bool {
+	return c.source(name) != nil
+}
+
+// Symbols 数据源同步的交易对
+func (c *ConCurrentEngine) Symbols(name string) []string {
+	s := c.source(name)
+	if s == nil {
+		return nil
+	}
+	return s.config.Symbols
+}
+
+// HasSymbol 数据源是否在同步该交易对
+func (c *ConCurrentEngine) HasSymbol(name string, symbol string) bool {
+	s := c.source(name)
+	if s == nil {
+		return false
+	}
+	for _, item := range s.config.Symbols {
+		if normalizeSymbol(item) == normalizeSymbol(symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *source) hasPeriod(period string) bool {
+	period, ok := standardPeriod(period)
+	if !ok {
+		return false
+	}
+	for _, item := range s.periods {
+		if item == period {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceLocation 数据源K线切分的时区，数据源不存在时使用引擎的时区
+func (c *ConCurrentEngine) sourceLocation(name string) *time.Location {
+	if s := c.source(name); s != nil {
+		return s.location
+	}
+	return c.location
+}
+
+func (c *ConCurrentEngine) source(name string) *source {
+	for _, s := range c.sources {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// KlinePeriodName 周期别名或表达式（如 3m、2h、3d）转换成标准周期
+func KlinePeriodName(period string) (string, bool) {
+	return standardPeriod(period)
+}
+
 func klineGetCollectionName(pair string, period string) string {
 	//fmt.Println("名称", period, periodMap[period])
-	return strings.ToLower(pair) + "_" + periodMap[period]
+	name, _ := standardPeriod(period)
+	return normalizeSymbol(pair) + "_" + name
+}
+
+// normalizeSymbol 各平台的交易对统一成小写无分隔符，如 BTC-USDT、BTC_USDT 都转成 btcusdt
+func normalizeSymbol(symbol string) string {
+	return strings.NewReplacer("-", "", "_", "", "/", "").Replace(strings.ToLower(symbol))
 }
 
-func klineCreateDateTime(ts int64, period string, currentTime int64, limit int) (int64, int64) {
+// NormalizeSymbol 统一交易对名称
+func NormalizeSymbol(symbol string) string {
+	return normalizeSymbol(symbol)
+}
 
-	prevTime := int64(0)
-	timeValue, ok := timeMap[period]
+// klineCreateDateTime 计算时间所在K线的开始时间和往前 limit 根的开始时间，limit 为负数时往后，按 loc 时区对齐
+func klineCreateDateTime(ts int64, period string, limit int, loc *time.Location) (int64, int64) {
+
+	p, ok := parsePeriod(period)
 	if !ok {
-		return currentTime, prevTime
-	}
-
-	// 月份的处理方式不一样
-	if "1mon" == period {
-		d := time.Unix(ts, 0)
-		d = time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, d.Location())
-		currentTime = d.Unix()
-		// 设置上一个时间
-		d.AddDate(0, -limit, 0)
-		prevTime = d.Unix()
-
-	} else if "1year" == period {
-		d := time.Unix(ts, 0)
-		d = time.Date(d.Year(), 1, 1, 0, 0, 0, 0, d.Location())
-		currentTime = d.Unix()
-		// 设置上一个时间
-		d.AddDate(-limit, 0, 0)
-		prevTime = d.Unix()
+		return 0, 0
+	}
 
-	} else {
+	current := p.start(ts, loc)
+	prev := current
+	for i := 0; i < limit; i++ {
+		prev = p.start(prev-1, loc)
+	}
+	for i := 0; i > limit; i-- {
+		prev = p.next(prev, loc)
+	}
+
+	return current, prev
+}
 
-		if currentTime <= 0 {
-			currentTime = ts
-			if timeValue != 0 {
-				currentTime -= ts % timeValue
+// NewEngine 创建引擎，每个数据源创建一个 worker，ctx 取消时停止获取历史数据
+func NewEngine(ctx context.Context, db *mongo.Database, mongoConfig *config.MongoConfig, config *config.EngineConfig) (*ConCurrentEngine, error) {
+
+	c, err := newEngine(db, mongoConfig, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range c.sources {
+		s.worker, err = newWorker(s.config, &c.config.Queue)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		source := s
+		s.worker.OnReconnect(func() {
+			go c.backfillGap(source)
+		})
+	}
+
+	if err := c.loadTradeMarks(); err != nil {
+		fmt.Println("读取成交 ID 失败", err)
+	}
+
+	// 创建索引，没有唯一索引时原子 upsert 会产生重复的K线，不能启动
+	for _, s := range c.sources {
+		for _, symbol := range s.config.Symbols {
+			for _, period := range s.periods {
+				if err := c.ensureIndex(s.name, symbol, period); err != nil {
+					c.Close()
+					return nil, fmt.Errorf("创建索引失败%s交易对：%s -- %s %w，有重复的K线时先执行 migrate 合并", s.name, symbol, period, err)
+				}
+				if err := c.checkMigrated(s.name, symbol, period); err != nil {
+					c.Close()
+					return nil, err
+				}
 			}
 		}
-		if timeSubValue, ok := timeSubMap[period]; ok {
-			currentTime = currentTime + timeSubValue
+	}
+
+	// 获取历史数据
+	for _, s := range c.sources {
+		for _, symbol := range s.config.Symbols {
+			for _, period := range s.periods {
+				if err := ctx.Err(); err != nil {
+					c.Close()
+					return nil, err
+				}
+				last, err := c.lastKLineTime(s.name, symbol, period)
+				if err != nil {
+					fmt.Println("查询最后一根K线失败", s.name, symbol, period, err)
+					continue
+				}
+				if last == 0 {
+					fmt.Printf("正在获取%s交易对：%s -- %s 的历史记录\n", s.name, symbol, period)
+					c.saveHistory(s, symbol, period)
+				}
+			}
 		}
-		prevTime = currentTime - (int64(limit) * timeValue)
 	}
 
-	return currentTime, prevTime
+	return c, nil
 }
 
-// NewEngine 创建ETH
-func NewEngine(db *mongo.Database, config *config.EngineConfig) (*ConCurrentEngine, error) {
+// newEngine 创建引擎并校验配置，不连接交易所
+func newEngine(db *mongo.Database, mongoConfig *config.MongoConfig, config *config.EngineConfig) (*ConCurrentEngine, error) {
 
-	var worker Worker
-	var err error
-	switch config.Platform {
-	case "huobi":
-		worker, err = NewHuoBiWorker(config)
+	if len(config.Sources) == 0 {
+		return nil, fmt.Errorf("没有配置数据源")
+	}
+
+	namespace := mongoConfig.Namespace
+	if namespace == "" {
+		namespace = NamespaceCollection
+	}
+	if namespace != NamespaceCollection && namespace != NamespaceDatabase {
+		return nil, fmt.Errorf("不支持的命名空间: %s", namespace)
+	}
+
+	location := time.Local
+	if config.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(config.Timezone)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("时区有误: %s %v", config.Timezone, err)
 		}
 	}
 
+	aggregation := config.Aggregation
+	if aggregation == "" {
+		aggregation = AggregationTrade
+	}
+	if aggregation != AggregationTrade && aggregation != AggregationRollup {
+		return nil, fmt.Errorf("不支持的聚合方式: %s", aggregation)
+	}
+
+	flushInterval := time.Duration(config.FlushInterval) * time.Millisecond
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	closeDelay := time.Duration(config.CloseDelay) * time.Millisecond
+	if closeDelay < 0 {
+		closeDelay = 0
+	}
+
 	c := &ConCurrentEngine{
-		worker: worker,
-		Db:     db,
-		config: config,
+		Db:            db,
+		namespace:     namespace,
+		config:        config,
+		aggregator:    newAggregator(),
+		rollups:       make(map[rollupKey]*rollupCandle),
+		dedup:         newTradeDedup(config.DedupWindow),
+		shards:        newShards(config.Shards, config.ShardQueue),
+		location:      location,
+		flushInterval: flushInterval,
+		closeDelay:    closeDelay,
+		aggregation:   aggregation,
+		done:          make(chan struct{}),
 	}
 
-	// 获取历史数据
-	for _, symbol := range c.config.Symbols {
-		for _, period := range c.config.Periods {
-			fmt.Printf("正在获取%s交易对：%s -- %s 的历史记录\n", c.config.Platform, symbol, period)
-			findOne := db.Collection(klineGetCollectionName(symbol, period)).FindOne(context.TODO(), nil)
-			if findOne.Err() != nil {
-				fmt.Println("请求", findOne.Err())
-				c.saveHistory(symbol, period)
+	for i := range config.Sources {
+		sourceConfig := &config.Sources[i]
+		name := sourceName(sourceConfig)
+		if c.source(name) != nil {
+			return nil, fmt.Errorf("数据源名称重复: %s", name)
+		}
+
+		periods, err := sourcePeriods(name, sourceConfig.Periods, aggregation)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceLocation := location
+		timezone := sourceConfig.Timezone
+		if timezone == "" {
+			timezone = platformTimezone[sourceConfig.Platform]
+		}
+		if timezone != "" {
+			sourceLocation, err = time.LoadLocation(timezone)
+			if err != nil {
+				return nil, fmt.Errorf("数据源 %s 时区有误: %s %v", name, timezone, err)
 			}
 		}
+
+		c.sources = append(c.sources, &source{
+			name:     name,
+			config:   sourceConfig,
+			periods:  periods,
+			location: sourceLocation,
+		})
 	}
 
 	return c, nil
 }
 
+// sourcePeriods 配置的周期转成标准周期并从低到高排序，为空时同步全部标准周期，rollup 模式下 1min 是合并的基础，必须同步
+func sourcePeriods(name string, periods []string, aggregation string) ([]string, error) {
+
+	if len(periods) == 0 {
+		return append([]string(nil), periodOrder...), nil
+	}
+
+	selected := make(map[string]periodSpec)
+	if aggregation == AggregationRollup {
+		selected[rollupBase] = periodSpec{n: 1, unit: unitMin}
+	}
+	for _, period := range periods {
+		p, ok := parsePeriod(period)
+		if !ok {
+			return nil, fmt.Errorf("数据源 %s 不支持的周期: %s，可选 %s 或者 Nm、Nh、Nd、Nw、NM 如 3m、2h、3d", name, period, strings.Join(periodOrder, ","))
+		}
+		selected[p.String()] = p
+	}
+
+	var result []string
+	for period := range selected {
+		result = append(result, period)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := selected[result[i]], selected[result[j]]
+		if a.maxSeconds() != b.maxSeconds() {
+			return a.maxSeconds() < b.maxSeconds()
+		}
+		return result[i] < result[j]
+	})
+	return result, nil
+}
+
+func newWorker(config *config.SourceConfig, queueConfig *config.QueueConfig) (Worker, error) {
+	switch config.Platform {
+	case "huobi":
+		return NewHuoBiWorker(config, queueConfig)
+	case "binance":
+		return NewBinanceWorker(config, queueConfig)
+	case "okx":
+		return NewOkxWorker(config, queueConfig)
+	}
+	return nil, fmt.Errorf("不支持的平台: %s", config.Platform)
+}
+
+// sourceName 数据源名称，没有配置时使用平台名
+func sourceName(config *config.SourceConfig) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	return config.Platform
+}
+
 func GZIPDe(in []byte) ([]byte, error) {
 	reader, err := gzip.NewReader(bytes.NewReader(in))
 	if err != nil {
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"encoding/json"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// decimal128Digits Decimal128 最多 34 位有效数字
+const decimal128Digits = 34
+
+// toDecimal128 decimal 转 Decimal128，有效数字超过 34 位时四舍五入
+func toDecimal128(d decimal.Decimal) primitive.Decimal128 {
+	// 去掉末尾多余的0
+	d, _ = decimal.NewFromString(d.String())
+	if n := len(d.Coefficient().String()); n > decimal128Digits {
+		if d.Sign() < 0 {
+			n--
+		}
+		d = d.Round(-d.Exponent() - int32(n-decimal128Digits))
+	}
+	v, ok := primitive.ParseDecimal128FromBigInt(d.Coefficient(), int(d.Exponent()))
+	if !ok {
+		return primitive.NewDecimal128(0, 0)
+	}
+	return v
+}
+
+// fromDecimal128 Decimal128 转 decimal
+func fromDecimal128(d primitive.Decimal128) decimal.Decimal {
+	bi, exp, err := d.BigInt()
+	if err != nil || bi.Sign() == 0 {
+		return decimal0
+	}
+	return decimal.NewFromBigInt(bi, int32(exp))
+}
+
+// kLineJSON 接口输出的格式，价格数量为字符串
+type kLineJSON struct {
+	Time       int64  `json:"time"`
+	Open       string `json:"open"`
+	Close      string `json:"close"`
+	Low        string `json:"low"`
+	High       string `json:"high"`
+	Amount     string `json:"amount"`
+	Vol        string `json:"vol"`
+	Count      int    `json:"count"`
+	BuyAmount  string `json:"buy_amount"`
+	SellAmount string `json:"sell_amount"`
+	BuyVol     string `json:"buy_vol"`
+}
+
+// MarshalJSON 输出和以前字符串存储时一样，不使用科学计数法
+func (k KLine) MarshalJSON() ([]byte, error) {
+	return json.Marshal(kLineJSON{
+		Time:   k.Time,
+		Open:   fromDecimal128(k.Open).String(),
+		Close:  fromDecimal128(k.Close).String(),
+		Low:    fromDecimal128(k.Low).String(),
+		High:   fromDecimal128(k.High).String(),
+		Amount: fromDecimal128(k.Amount).String(),
+		Vol:    fromDecimal128(k.Vol).String(),
+		Count:  k.Count,
+
+		BuyAmount:  fromDecimal128(k.BuyAmount).String(),
+		SellAmount: fromDecimal128(k.SellAmount).String(),
+		BuyVol:     fromDecimal128(k.BuyVol).String(),
+	})
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+	"time"
+)
+
+// TradeMarkCollection 保存每个交易对已经写入的最大成交 ID
+const TradeMarkCollection = "trade_mark"
+
+type dedupKey struct {
+	name   string
+	symbol string
+}
+
+// tradeDedup 按成交 ID 去重，每个交易对只保留最近 window 个 ID
+// 比保留的 ID 更早的成交认为已经处理过，重启后以保存的最大 ID 为界
+type tradeDedup struct {
+	mu     sync.Mutex
+	window int
+	series map[dedupKey]*dedupWindow
+}
+
+type dedupWindow struct {
+	seen  map[int64]struct{}
+	ring  []int64 // 按处理顺序保存的 ID，满了之后淘汰最早的
+	next  int
+	floor int64 // 小于等于 floor 的 ID 都已经处理过
+}
+
+func newTradeDedup(window int) *tradeDedup {
+	return &tradeDedup{
+		window: window,
+		series: make(map[dedupKey]*dedupWindow),
+	}
+}
+
+// seen 成交是否已经处理过，没有成交 ID 或者关闭了去重时都没有处理过
+func (d *tradeDedup) seen(name string, symbol string, id int64) bool {
+
+	if d.window <= 0 || id <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w := d.get(dedupKey{name: name, symbol: normalizeSymbol(symbol)})
+	if id <= w.floor {
+		return true
+	}
+	_, ok := w.seen[id]
+	return ok
+}
+
+// record 记录已经放入分片的成交，之后同样的 ID 认为已经处理过
+func (d *tradeDedup) record(name string, symbol string, id int64) {
+
+	if d.window <= 0 || id <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w := d.get(dedupKey{name: name, symbol: normalizeSymbol(symbol)})
+	if id <= w.floor {
+		return
+	}
+	if _, ok := w.seen[id]; ok {
+		return
+	}
+
+	if len(w.ring) < d.window {
+		w.ring = append(w.ring, id)
+	} else {
+		evicted := w.ring[w.next]
+		delete(w.seen, evicted)
+		if evicted > w.floor {
+			w.floor = evicted
+		}
+		w.ring[w.next] = id
+		w.next = (w.next + 1) % d.window
+	}
+	w.seen[id] = struct{}{}
+}
+
+func (d *tradeDedup) get(key dedupKey) *dedupWindow {
+	w, ok := d.series[key]
+	if !ok {
+		w = &dedupWindow{seen: make(map[int64]struct{})}
+		d.series[key] = w
+	}
+	return w
+}
+
+// restore 启动时恢复保存的最大 ID
+func (d *tradeDedup) restore(key dedupKey, high int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w := d.get(key)
+	if high > w.floor {
+		w.floor = high
+	}
+}
+
+// loadTradeMarks 读取保存的最大成交 ID
+func (c *ConCurrentEngine) loadTradeMarks() error {
+
+	cur, err := c.Db.Collection(TradeMarkCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	for cur.Next(context.TODO()) {
+		var mark struct {
+			Name   string `bson:"name"`
+			Symbol string `bson:"symbol"`
+			High   int64  `bson:"high"`
+		}
+		if err := cur.Decode(&mark); err != nil {
+			return err
+		}
+		c.dedup.restore(dedupKey{name: mark.Name, symbol: mark.Symbol}, mark.High)
+	}
+	return cur.Err()
+}
+
+// saveTradeMarks K线写入成功后保存合并过的最大成交 ID，只会增大
+func (c *ConCurrentEngine) saveTradeMarks(marks map[dedupKey]int64) error {
+
+	if len(marks) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(marks))
+	for key, high := range marks {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": key.name + "_" + key.symbol}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"name": key.name, "symbol": key.symbol, "updated_at": time.Now().Unix()},
+				"$max": bson.M{"high": high},
+			}).
+			SetUpsert(true))
+	}
+
+	_, err := c.Db.Collection(TradeMarkCollection).BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+	return err
+}
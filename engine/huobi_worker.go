@@ -6,22 +6,23 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/mitchellh/mapstructure"
 	"github.com/shopspring/decimal"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"sync-kline/client"
 	"sync-kline/config"
 	"time"
 )
 
 type HuoBiWorker struct {
-	conn          *websocket.Conn
-	reconnection  int
-	httpClient    *client.Client
-	symbols       []string
-	tradeDetailCh chan *TradeDetailCh
+	workerBase
+	httpClient *client.Client
+	wsUrl      string
+	dialer     websocket.Dialer
+	reqMu      sync.Mutex
+	reqConn    *websocket.Conn // 请求历史K线单独的连接，不影响订阅
 }
 
 type HuoBiWsMessageRes struct {
@@ -38,6 +39,16 @@ type HuoBiHttpRes struct {
 	Data   interface{} `json:"data"`
 }
 
+// HuoBiWsRepRes websocket 请求的响应
+type HuoBiWsRepRes struct {
+	Ping   int64            `json:"ping"`
+	Id     string           `json:"id"`
+	Rep    string           `json:"rep"`
+	Status string           `json:"status"`
+	ErrMsg string           `json:"err-msg"`
+	Data   []*HuoBiKlineRes `json:"data"`
+}
+
 type HuoBiKlineRes struct {
 	Id     int64   `mapstructure:"id"`
 	Open   float64 `mapstructure:"open"`
@@ -62,60 +73,62 @@ type HuoBiTradeDetailRes struct {
 	} `mapstructure:"data"`
 }
 
+// huobiPeriodMap 火币支持的周期
+var huobiPeriodMap = map[string]string{
+	"1min":  "1min",
+	"5min":  "5min",
+	"15min": "15min",
+	"30min": "30min",
+	"1hour": "60min",
+	"4hour": "4hour",
+	"1day":  "1day",
+	"1week": "1week",
+	"1mon":  "1mon",
+	"1year": "1year",
+}
+
+// huobiHistorySize websocket 请求历史K线每次最多 300 根
+const huobiHistorySize = 300
+
 func (w *HuoBiWorker) Close() error {
+	w.reqMu.Lock()
+	if w.reqConn != nil {
+		w.reqConn.Close()
+		w.reqConn = nil
+	}
+	w.reqMu.Unlock()
 	return w.conn.Close()
 }
 
-func (w *HuoBiWorker) Start() {
-
-	go w.readMessage()
+func (w *HuoBiWorker) readMessage(message []byte) {
 
-	for _, symbol := range w.symbols {
-		go w.SubscribeTradeDetail(symbol)
+	bytes, err := GZIPDe(message)
+	if err != nil {
+		return
 	}
+	//log.Printf("recv: %s", string(bytes))
 
-}
+	var res HuoBiWsMessageRes
+	err = json.Unmarshal(bytes, &res)
+	if err != nil {
+		return
+	}
 
-func (w *HuoBiWorker) readMessage() {
-	for {
-		_, message, err := w.conn.ReadMessage()
+	if res.Ping > 0 {
+		req := make(map[string]interface{})
+		req["pong"] = res.Ping
+		marshal, err := json.Marshal(req)
 		if err != nil {
-			log.Println("read:", err)
-			if w.reconnection >= 10 {
-				return
-			}
-			fmt.Println("正在尝试重连")
-			w.Start()
 			return
 		}
-
-		bytes, err := GZIPDe(message)
-		if err != nil {
-			continue
-		}
-		//log.Printf("recv: %s", string(bytes))
-
-		var res HuoBiWsMessageRes
-		err = json.Unmarshal(bytes, &res)
-		if err != nil {
-			continue
-		}
-
-		if res.Ping > 0 {
-			req := make(map[string]interface{})
-			req["pong"] = time.Now().UnixMilli()
-			marshal, err := json.Marshal(req)
-			if err != nil {
-				continue
-			}
-			w.WriteMessage(marshal)
-			continue
-		}
-
-		if strings.Contains(res.Ch, "trade.detail") {
-			w.formatTradeDetail(&res)
+		if err := w.WriteMessage(marshal); err != nil {
+			w.reportError(err)
 		}
+		return
+	}
 
+	if strings.Contains(res.Ch, "trade.detail") {
+		w.formatTradeDetail(&res)
 	}
 }
 
@@ -125,49 +138,42 @@ func (w *HuoBiWorker) formatTradeDetail(res *HuoBiWsMessageRes) {
 
 	var tick HuoBiTradeDetailRes
 	if err := mapstructure.Decode(res.Tick, &tick); err != nil {
-		fmt.Println("解析失败", err)
+		w.decodeError(err)
 		return
 	}
 
 	for _, item := range tick.Data {
-		w.tradeDetailCh <- &TradeDetailCh{
-			Symbol: ch[1],
-			Time:   tick.Ts / 1000,
-			Amount: decimal.NewFromFloat(item.Amount),
-			Price:  decimal.NewFromFloat(item.Price),
-		}
-	}
-}
-
-func (w *HuoBiWorker) WriteMessage(msg []byte) {
-
-	err := w.conn.WriteMessage(websocket.TextMessage, msg)
-	if err != nil {
-		log.Println("write:", err)
-		return
+		w.emit(&TradeDetailCh{
+			Symbol:  ch[1],
+			Time:    tick.Ts / 1000,
+			Amount:  decimal.NewFromFloat(item.Amount),
+			Price:   decimal.NewFromFloat(item.Price),
+			TradeId: item.TradeId,
+			Side:    item.Direction,
+		})
 	}
-
 }
 
-func (w *HuoBiWorker) SubscribeTradeDetail(symbol string) {
+// huobiSubscribeMsg 订阅成交的消息
+func huobiSubscribeMsg(symbol string) ([]byte, error) {
 
 	req := make(map[string]interface{})
 	req["sub"] = fmt.Sprintf("market.%s.trade.detail", symbol)
 	req["id"] = strconv.FormatInt(time.Now().Unix(), 10)
 
-	marshal, err := json.Marshal(req)
-	if err != nil {
-		return
-	}
-	w.WriteMessage(marshal)
-
+	return json.Marshal(req)
 }
 
 func (w *HuoBiWorker) HistoryKline(symbol string, period string) ([]*KLine, error) {
 
+	name, ok := huobiPeriod(period)
+	if !ok {
+		return nil, fmt.Errorf("huobi %w: %s", ErrPeriodNotSupported, period)
+	}
+
 	params := url.Values{}
 	params["symbol"] = []string{symbol}
-	params["period"] = []string{period}
+	params["period"] = []string{name}
 	params["size"] = []string{"2000"}
 
 	path := "/market/history/kline"
@@ -185,28 +191,133 @@ func (w *HuoBiWorker) HistoryKline(symbol string, period string) ([]*KLine, erro
 		return nil, err
 	}
 
+	return huobiKLines(data), nil
+}
+
+// HistoryKlineBefore 通过 websocket 请求 before 之前的一段K线，http 接口只能取最近 2000 根
+// 按时间范围请求，范围内没有数据（还没上线）时返回空
+func (w *HuoBiWorker) HistoryKlineBefore(symbol string, period string, before int64) ([]*KLine, error) {
+
+	name, ok := huobiPeriod(period)
+	if !ok {
+		return nil, fmt.Errorf("huobi %w: %s", ErrPeriodNotSupported, period)
+	}
+	p, _ := parsePeriod(period)
+	from := before - p.maxSeconds()*huobiHistorySize
+	if from < 0 {
+		from = 0
+	}
+
+	req := make(map[string]interface{})
+	req["req"] = fmt.Sprintf("market.%s.kline.%s", symbol, name)
+	req["id"] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	req["from"] = from
+	req["to"] = before - 1
+
+	res, err := w.request(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Status != "ok" {
+		return nil, fmt.Errorf("huobi 请求失败: %s", res.ErrMsg)
+	}
+
+	return huobiKLines(res.Data), nil
+}
+
+// request 发送 websocket 请求并等待对应 id 的响应，连接出错时下次重新连接
+func (w *HuoBiWorker) request(req map[string]interface{}) (*HuoBiWsRepRes, error) {
+
+	w.reqMu.Lock()
+	defer w.reqMu.Unlock()
+
+	if w.reqConn == nil {
+		conn, _, err := w.dialer.Dial(w.wsUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.reqConn = conn
+	}
+
+	res, err := w.roundTrip(req)
+	if err != nil {
+		w.reqConn.Close()
+		w.reqConn = nil
+		return nil, err
+	}
+	return res, nil
+}
+
+func (w *HuoBiWorker) roundTrip(req map[string]interface{}) (*HuoBiWsRepRes, error) {
+
+	marshal, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = w.reqConn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := w.reqConn.WriteMessage(websocket.TextMessage, marshal); err != nil {
+		return nil, err
+	}
+
+	for {
+		_ = w.reqConn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		_, message, err := w.reqConn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := GZIPDe(message)
+		if err != nil {
+			return nil, err
+		}
+
+		var res HuoBiWsRepRes
+		if err := json.Unmarshal(bytes, &res); err != nil {
+			return nil, err
+		}
+		if res.Ping > 0 {
+			pong, _ := json.Marshal(map[string]interface{}{"pong": res.Ping})
+			_ = w.reqConn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.reqConn.WriteMessage(websocket.TextMessage, pong); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.Id == req["id"] {
+			return &res, nil
+		}
+	}
+}
+
+// huobiPeriod 标准周期转成火币的周期
+func huobiPeriod(period string) (string, bool) {
+	period, _ = standardPeriod(period)
+	name, ok := huobiPeriodMap[period]
+	return name, ok
+}
+
+func huobiKLines(data []*HuoBiKlineRes) []*KLine {
 	var klines []*KLine
 	for _, item := range data {
 		klines = append(klines, &KLine{
 			Time:   item.Id,
-			Open:   decimal.NewFromFloat(item.Open).String(),
-			Close:  decimal.NewFromFloat(item.Close).String(),
-			Low:    decimal.NewFromFloat(item.Low).String(),
-			High:   decimal.NewFromFloat(item.High).String(),
-			Amount: decimal.NewFromFloat(item.Amount).String(),
-			Vol:    decimal.NewFromFloat(item.Vol).String(),
+			Open:   toDecimal128(decimal.NewFromFloat(item.Open)),
+			Close:  toDecimal128(decimal.NewFromFloat(item.Close)),
+			Low:    toDecimal128(decimal.NewFromFloat(item.Low)),
+			High:   toDecimal128(decimal.NewFromFloat(item.High)),
+			Amount: toDecimal128(decimal.NewFromFloat(item.Amount)),
+			Vol:    toDecimal128(decimal.NewFromFloat(item.Vol)),
 			Count:  item.Count,
 		})
 	}
-
-	return klines, nil
+	return klines
 }
 
-func (w *HuoBiWorker) ReadTradeDetailCh() *TradeDetailCh {
-	return <-w.tradeDetailCh
-}
+func NewHuoBiWorker(config *config.SourceConfig, queueConfig *config.QueueConfig) (*HuoBiWorker, error) {
 
-func NewHuoBiWorker(config *config.EngineConfig) (*HuoBiWorker, error) {
+	queue, err := newTradeQueue(sourceName(config), queueConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	var proxy func(r *http.Request) (*url.URL, error)
 	if len(config.ProxyUrl) > 0 {
@@ -214,19 +325,18 @@ func NewHuoBiWorker(config *config.EngineConfig) (*HuoBiWorker, error) {
 		proxy = http.ProxyURL(uProxy)
 	}
 
-	dialer := websocket.Dialer{Proxy: proxy}
-	conn, _, err := dialer.Dial(config.WsUrl, nil)
-	if err != nil {
-		fmt.Println("dial:", err)
-		return nil, err
-	}
+	conn := newWsConn(config.WsUrl, proxy)
 
 	httpClient := client.NewClient(config.HttpUrl, proxy)
 
-	return &HuoBiWorker{
-		conn:          conn,
-		httpClient:    httpClient,
-		symbols:       config.Symbols,
-		tradeDetailCh: make(chan *TradeDetailCh),
-	}, nil
+	w := &HuoBiWorker{
+		workerBase: newWorkerBase("huobi", conn, config.Symbols, queue),
+		httpClient: httpClient,
+		wsUrl:      config.WsUrl,
+		dialer:     conn.dialer,
+	}
+	w.subscribeMsg = huobiSubscribeMsg
+	w.init(w.readMessage)
+
+	return w, nil
 }
@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync-kline/config"
+)
+
+// migrateFields 需要转换成 Decimal128 的字段
+var migrateFields = []string{"open", "close", "low", "high", "amount", "vol"}
+
+// migrateBatch 每批写入的数量
+const migrateBatch = 1000
+
+// MigrateDecimal 把字符串（或浮点数）存储的价格数量一次性转换成 Decimal128
+// 包括所有数据源的集合，以及多数据源之前没有前缀的集合（MigrateNamespace 没有改名的）
+func MigrateDecimal(db *mongo.Database, mongoConfig *config.MongoConfig, config *config.EngineConfig) error {
+
+	c, err := newEngine(db, mongoConfig, config)
+	if err != nil {
+		return err
+	}
+
+	names := append([]string{""}, c.Sources()...)
+	for _, name := range names {
+		s := c.source(name)
+		for _, symbol := range c.migrateSymbols(s) {
+			for _, period := range periodOrder {
+				collection := c.KLineCollection(name, symbol, period)
+				count, err := migrateCollection(collection)
+				if err != nil {
+					return fmt.Errorf("%s 转换失败: %v", collection.Name(), err)
+				}
+				if count > 0 {
+					fmt.Printf("%s.%s 转换 %d 条\n", collection.Database().Name(), collection.Name(), count)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// MigrateDuplicates 合并同一时间的重复K线（没有唯一索引时并发写入产生的）并创建唯一索引
+// 需要在 MigrateDecimal 之后执行，按写入的先后合并，开盘价取最早的，收盘价取最后的，数量累加
+func MigrateDuplicates(db *mongo.Database, mongoConfig *config.MongoConfig, config *config.EngineConfig) error {
+
+	c, err := newEngine(db, mongoConfig, config)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range c.sources {
+		for _, symbol := range s.config.Symbols {
+			for _, period := range s.periods {
+				collection := c.KLineCollection(s.name, symbol, period)
+				count, err := migrateDuplicates(collection)
+				if err != nil {
+					return fmt.Errorf("%s 合并失败: %v", collection.Name(), err)
+				}
+				if count > 0 {
+					fmt.Printf("%s.%s 合并 %d 根重复的K线\n", collection.Database().Name(), collection.Name(), count)
+				}
+				if err := c.ensureIndex(s.name, symbol, period); err != nil {
+					return fmt.Errorf("%s 创建索引失败: %v", collection.Name(), err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func migrateDuplicates(collection *mongo.Collection) (int, error) {
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$time", "ids": bson.M{"$push": "$_id"}, "n": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"n": bson.M{"$gt": 1}}}},
+	}
+	cur, err := collection.Aggregate(context.Background(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	count := 0
+	for cur.Next(context.Background()) {
+		var group struct {
+			Ids []interface{} `bson:"ids"`
+		}
+		if err := cur.Decode(&group); err != nil {
+			return count, err
+		}
+		if err := migrateMerge(collection, group.Ids); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cur.Err()
+}
+
+// migrateMerge 合并到最早写入的一条，删除其它的
+func migrateMerge(collection *mongo.Collection, ids []interface{}) error {
+
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	cur, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, findOptions)
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		Id    interface{} `bson:"_id"`
+		KLine `bson:",inline"`
+	}
+	if err := cur.All(context.Background(), &docs); err != nil {
+		return err
+	}
+	if len(docs) < 2 {
+		return nil
+	}
+
+	merged := KLine{Time: docs[0].Time}
+	for i := range docs {
+		klineMerge(&merged, &docs[i].KLine)
+	}
+
+	if _, err := collection.UpdateOne(context.Background(), bson.M{"_id": docs[0].Id}, bson.M{"$set": merged}); err != nil {
+		return err
+	}
+	others := make(bson.A, 0, len(docs)-1)
+	for _, doc := range docs[1:] {
+		others = append(others, doc.Id)
+	}
+	_, err = collection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": others}})
+	return err
+}
+
+// MigrateNamespace 多数据源之前没有前缀的集合属于默认数据源（第一个），改名到默认数据源的命名空间
+// 默认数据源的集合已经存在时（改名之前已经运行过），只补上没有的K线，原集合保留，确认后手动删除
+func MigrateNamespace(db *mongo.Database, mongoConfig *config.MongoConfig, config *config.EngineConfig) error {
+
+	c, err := newEngine(db, mongoConfig, config)
+	if err != nil {
+		return err
+	}
+
+	s := c.sources[0]
+	for _, symbol := range s.config.Symbols {
+		for _, period := range periodOrder {
+			legacy := c.KLineCollection("", symbol, period)
+			target := c.KLineCollection(s.name, symbol, period)
+			if err := migrateRename(legacy, target); err != nil {
+				return fmt.Errorf("%s 改名失败: %v", legacy.Name(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func migrateRename(legacy *mongo.Collection, target *mongo.Collection) error {
+
+	exists, err := collectionExists(legacy)
+	if err != nil || !exists {
+		return err
+	}
+	targetExists, err := collectionExists(target)
+	if err != nil {
+		return err
+	}
+
+	from := legacy.Database().Name() + "." + legacy.Name()
+	to := target.Database().Name() + "." + target.Name()
+	if !targetExists {
+		err := legacy.Database().Client().Database("admin").RunCommand(context.Background(), bson.D{
+			{Key: "renameCollection", Value: from},
+			{Key: "to", Value: to},
+		}).Err()
+		if err == nil {
+			fmt.Printf("%s 改名为 %s\n", from, to)
+		}
+		return err
+	}
+
+	// 按时间补上没有的K线，已有的以新集合为准
+	cur, err := legacy.Find(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+
+	count := 0
+	var models []mongo.WriteModel
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := target.BulkWrite(context.Background(), models, options.BulkWrite().SetOrdered(false))
+		if res != nil {
+			count += int(res.UpsertedCount)
+		}
+		models = models[:0]
+		return err
+	}
+
+	for cur.Next(context.Background()) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		delete(doc, "_id")
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"time": doc["time"]}).
+			SetUpdate(bson.M{"$setOnInsert": doc}).
+			SetUpsert(true))
+
+		if len(models) >= migrateBatch {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s 已存在，从 %s 补充 %d 条，确认后可以删除 %s\n", to, from, count, from)
+	return nil
+}
+
+func collectionExists(collection *mongo.Collection) (bool, error) {
+	names, err := collection.Database().ListCollectionNames(context.Background(), bson.M{"name": collection.Name()})
+	if err != nil {
+		return false, err
+	}
+	return len(names) > 0, nil
+}
+
+// migrateSymbols 数据源的交易对，没有前缀的集合取所有数据源的交易对
+func (c *ConCurrentEngine) migrateSymbols(s *source) []string {
+	if s != nil {
+		return s.config.Symbols
+	}
+	var symbols []string
+	for _, item := range c.sources {
+		symbols = append(symbols, item.config.Symbols...)
+	}
+	return symbols
+}
+
+func migrateCollection(collection *mongo.Collection) (int, error) {
+
+	or := make(bson.A, len(migrateFields))
+	for i, field := range migrateFields {
+		or[i] = bson.M{field: bson.M{"$type": bson.A{"string", "double", "int", "long"}}}
+	}
+
+	cur, err := collection.Find(context.Background(), bson.M{"$or": or})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	count := 0
+	var models []mongo.WriteModel
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(context.Background(), models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+
+	for cur.Next(context.Background()) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return count, err
+		}
+
+		set := bson.M{}
+		for _, field := range migrateFields {
+			value, ok := migrateValue(doc[field])
+			if !ok {
+				continue
+			}
+			set[field] = value
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc["_id"]}).
+			SetUpdate(bson.M{"$set": set}))
+		count++
+
+		if len(models) >= migrateBatch {
+			if err := write(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return count, err
+	}
+
+	return count, write()
+}
+
+// migrateValue 旧数据转成 Decimal128，已经是 Decimal128 的不需要转换
+func migrateValue(value interface{}) (primitive.Decimal128, bool) {
+	switch v := value.(type) {
+	case string:
+		d, err := decimal.NewFromString(v)
+		if err != nil {
+			return primitive.Decimal128{}, false
+		}
+		return toDecimal128(d), true
+	case float64:
+		return toDecimal128(decimal.NewFromFloat(v)), true
+	case int32:
+		return toDecimal128(decimal.NewFromInt32(v)), true
+	case int64:
+		return toDecimal128(decimal.NewFromInt(v)), true
+	}
+	return primitive.Decimal128{}, false
+}
@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync-kline/client"
+	"sync-kline/config"
+	"time"
+)
+
+type OkxWorker struct {
+	workerBase
+	httpClient *client.Client
+}
+
+type OkxArg struct {
+	Channel string `json:"channel"`
+	InstId  string `json:"instId"`
+}
+
+type OkxWsMessageRes struct {
+	Event string          `json:"event"`
+	Code  string          `json:"code"`
+	Msg   string          `json:"msg"`
+	Arg   OkxArg          `json:"arg"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type OkxTradeRes struct {
+	InstId  string `json:"instId"`
+	TradeId string `json:"tradeId"`
+	Px      string `json:"px"`
+	Sz      string `json:"sz"`
+	Side    string `json:"side"`
+	Ts      string `json:"ts"`
+}
+
+type OkxHttpRes struct {
+	Code string     `json:"code"`
+	Msg  string     `json:"msg"`
+	Data [][]string `json:"data"`
+}
+
+var okxPeriodMap = map[string]string{
+	"1min":  "1m",
+	"5min":  "5m",
+	"15min": "15m",
+	"30min": "30m",
+	"1hour": "1H",
+	"4hour": "4H",
+	"1day":  "1D",
+	"1week": "1W",
+	"1mon":  "1M",
+}
+
+// okxQuotes 不带分隔符的交易对按计价币拆分，长的放前面
+var okxQuotes = []string{"usdt", "usdc", "usd", "btc", "eth", "okb", "dai", "eur"}
+
+// okxPingPeriod 30秒内没有消息服务端会断开
+const okxPingPeriod = 20 * time.Second
+
+func (w *OkxWorker) readMessage(message []byte) {
+
+	if string(message) == "pong" {
+		return
+	}
+
+	var res OkxWsMessageRes
+	err := json.Unmarshal(message, &res)
+	if err != nil {
+		return
+	}
+
+	if res.Event == "error" {
+		w.reportError(&WorkerError{Platform: w.platform, Op: OpSubscribe, Symbol: okxSymbol(res.Arg.InstId), Err: &ExchangeError{Code: res.Code, Msg: res.Msg}})
+		return
+	}
+
+	if res.Event == "" && res.Arg.Channel == "trades" {
+		w.formatTradeDetail(res.Data)
+	}
+}
+
+func (w *OkxWorker) formatTradeDetail(data json.RawMessage) {
+
+	var trades []OkxTradeRes
+	if err := json.Unmarshal(data, &trades); err != nil {
+		w.decodeError(err)
+		return
+	}
+
+	for _, item := range trades {
+		price, err := decimal.NewFromString(item.Px)
+		if err != nil {
+			continue
+		}
+		amount, err := decimal.NewFromString(item.Sz)
+		if err != nil {
+			continue
+		}
+		ts, _ := strconv.ParseInt(item.Ts, 10, 64)
+		tradeId, _ := strconv.ParseInt(item.TradeId, 10, 64)
+		w.emit(&TradeDetailCh{
+			Symbol:  okxSymbol(item.InstId),
+			Time:    ts / 1000,
+			Amount:  amount,
+			Price:   price,
+			TradeId: tradeId,
+			Side:    item.Side,
+		})
+	}
+}
+
+// okxSubscribeMsg 订阅成交的消息
+func okxSubscribeMsg(symbol string) ([]byte, error) {
+
+	req := make(map[string]interface{})
+	req["op"] = "subscribe"
+	req["args"] = []OkxArg{{Channel: "trades", InstId: okxInstId(symbol)}}
+
+	return json.Marshal(req)
+}
+
+func (w *OkxWorker) HistoryKline(symbol string, period string) ([]*KLine, error) {
+	return w.candles(symbol, period, 0)
+}
+
+// HistoryKlineBefore before 之前的 100 根K线，返回的是最近的K线，没有数据说明已经到了上线时间
+func (w *OkxWorker) HistoryKlineBefore(symbol string, period string, before int64) ([]*KLine, error) {
+	kLines, err := w.candles(symbol, period, before*1000)
+	if err == nil && len(kLines) == 0 {
+		return nil, fmt.Errorf("okx %w: %s %d", ErrHistoryStart, symbol, before)
+	}
+	return kLines, err
+}
+
+// candles after 为 0 时取最近的K线，否则取 after（毫秒）之前的K线
+func (w *OkxWorker) candles(symbol string, period string, after int64) ([]*KLine, error) {
+
+	standard, _ := standardPeriod(period)
+	bar, ok := okxPeriodMap[standard]
+	if !ok {
+		return nil, fmt.Errorf("okx %w: %s", ErrPeriodNotSupported, period)
+	}
+
+	params := url.Values{}
+	params["instId"] = []string{okxInstId(symbol)}
+	params["bar"] = []string{bar}
+	params["limit"] = []string{"100"}
+	if after > 0 {
+		params["after"] = []string{strconv.FormatInt(after, 10)}
+	}
+
+	path := "/api/v5/market/history-candles"
+
+	var res OkxHttpRes
+
+	err := w.httpClient.Get(path, params, &res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Code != "0" {
+		return nil, fmt.Errorf("okx 请求失败: %s %s", res.Code, res.Msg)
+	}
+
+	// [开盘时间, 开盘价, 最高价, 最低价, 收盘价, 成交量, 成交量(币), 成交额, 是否完结]
+	var klines []*KLine
+	for _, item := range res.Data {
+		if len(item) < 8 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(item[0], 10, 64)
+		klines = append(klines, &KLine{
+			Time:   ts / 1000,
+			Open:   toDecimal128(okxDecimal(item[1])),
+			High:   toDecimal128(okxDecimal(item[2])),
+			Low:    toDecimal128(okxDecimal(item[3])),
+			Close:  toDecimal128(okxDecimal(item[4])),
+			Amount: toDecimal128(okxDecimal(item[5])),
+			Vol:    toDecimal128(okxDecimal(item[7])),
+		})
+	}
+
+	return klines, nil
+}
+
+func okxDecimal(s string) decimal.Decimal {
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return decimal0
+	}
+	return d
+}
+
+// okxInstId btcusdt 转成 BTC-USDT
+func okxInstId(symbol string) string {
+	if strings.Contains(symbol, "-") {
+		return strings.ToUpper(symbol)
+	}
+	symbol = normalizeSymbol(symbol)
+	for _, quote := range okxQuotes {
+		if len(symbol) > len(quote) && strings.HasSuffix(symbol, quote) {
+			return strings.ToUpper(symbol[:len(symbol)-len(quote)] + "-" + quote)
+		}
+	}
+	return strings.ToUpper(symbol)
+}
+
+// okxSymbol BTC-USDT 转成 btcusdt
+func okxSymbol(instId string) string {
+	return normalizeSymbol(instId)
+}
+
+func NewOkxWorker(config *config.SourceConfig, queueConfig *config.QueueConfig) (*OkxWorker, error) {
+
+	queue, err := newTradeQueue(sourceName(config), queueConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy func(r *http.Request) (*url.URL, error)
+	if len(config.ProxyUrl) > 0 {
+		uProxy, _ := url.Parse(config.ProxyUrl)
+		proxy = http.ProxyURL(uProxy)
+	}
+
+	conn := newWsConn(config.WsUrl, proxy)
+	conn.pingMessage = []byte("ping")
+	conn.pingPeriod = okxPingPeriod
+
+	httpClient := client.NewClient(config.HttpUrl, proxy)
+
+	w := &OkxWorker{
+		workerBase: newWorkerBase("okx", conn, config.Symbols, queue),
+		httpClient: httpClient,
+	}
+	w.subscribeMsg = okxSubscribeMsg
+	w.init(w.readMessage)
+
+	return w, nil
+}
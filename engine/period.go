@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// 周期单位
+const (
+	unitMin  = "min"
+	unitHour = "hour"
+	unitDay  = "day"
+	unitWeek = "week"
+	unitMon  = "mon"
+	unitYear = "year"
+)
+
+const (
+	secondsPerDay = 24 * 60 * 60
+	// epochMonday 1970-01-05 是 1970 年的第一个周一，多周K线从这天开始对齐
+	epochMonday = 4
+)
+
+// ErrPeriodNotSupported 交易所没有该周期的历史K线，可以由 1min 用 rebuild 生成
+var ErrPeriodNotSupported = errors.New("交易所不支持该周期")
+
+// ErrHistoryStart 交易所没有更早的K线，已经到了交易对上线的时间
+var ErrHistoryStart = errors.New("交易所没有更早的K线")
+
+// periodUnits 周期表达式的单位，如 3m、2h、3d、2w，也可以写完整的单位 3min、2hour
+var periodUnits = map[string]string{
+	"m":    unitMin,
+	"min":  unitMin,
+	"h":    unitHour,
+	"hour": unitHour,
+	"d":    unitDay,
+	"day":  unitDay,
+	"w":    unitWeek,
+	"week": unitWeek,
+	"M":    unitMon,
+	"mon":  unitMon,
+	"y":    unitYear,
+	"year": unitYear,
+}
+
+// periodSpec n 个 unit 的周期
+// 对齐规则：一天以内的周期和交易所一样按 UTC 从 1970-01-01 开始对齐，和时区无关，
+// 半小时时区（如 Asia/Kolkata）的 1hour 按当地时间在半点开始，夏令时切换前后 4hour 按当地时间看差一个小时；
+// 天、周、月、年按时区的当地日期切分，多天从 1970-01-01 开始按天数对齐，多周从 1970-01-05（周一）开始按周数对齐，
+// 多月从每年一月开始对齐（3mon 即季度），多年从公元 0 年开始对齐
+type periodSpec struct {
+	n    int64
+	unit string
+}
+
+// parsePeriod 解析周期，别名先转成标准名称，分钟为 60 的整数倍时转成小时，如 120m 即 2hour
+func parsePeriod(period string) (periodSpec, bool) {
+
+	if name, ok := periodMap[period]; ok {
+		period = name
+	}
+
+	i := 0
+	for i < len(period) && period[i] >= '0' && period[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(period[:i], 10, 64)
+	if err != nil || n <= 0 {
+		return periodSpec{}, false
+	}
+	unit, ok := periodUnits[period[i:]]
+	if !ok {
+		return periodSpec{}, false
+	}
+
+	p := periodSpec{n: n, unit: unit}
+	if p.unit == unitMin && p.n%60 == 0 {
+		p = periodSpec{n: n / 60, unit: unitHour}
+	}
+	if p.intraday() && p.step() > secondsPerDay {
+		return periodSpec{}, false
+	}
+	return p, true
+}
+
+// standardPeriod 周期的标准名称，同一个周期不同的写法使用同一个集合
+func standardPeriod(period string) (string, bool) {
+	p, ok := parsePeriod(period)
+	if !ok {
+		return "", false
+	}
+	return p.String(), true
+}
+
+func (p periodSpec) String() string {
+	return strconv.FormatInt(p.n, 10) + p.unit
+}
+
+func (p periodSpec) intraday() bool {
+	return p.unit == unitMin || p.unit == unitHour
+}
+
+// step 一天以内的周期的秒数
+func (p periodSpec) step() int64 {
+	if p.unit == unitMin {
+		return p.n * 60
+	}
+	return p.n * 60 * 60
+}
+
+// maxSeconds 一根K线最长的秒数，用于排序和按时间范围请求
+func (p periodSpec) maxSeconds() int64 {
+	switch p.unit {
+	case unitDay:
+		return p.n * secondsPerDay
+	case unitWeek:
+		return p.n * 7 * secondsPerDay
+	case unitMon:
+		return p.n * 31 * secondsPerDay
+	case unitYear:
+		return p.n * 366 * secondsPerDay
+	}
+	return p.step()
+}
+
+// start ts 所在K线的开始时间
+func (p periodSpec) start(ts int64, loc *time.Location) int64 {
+
+	d := time.Unix(ts, 0).In(loc)
+
+	switch p.unit {
+	case unitYear:
+		year := int64(d.Year())
+		return time.Date(int(year-year%p.n), 1, 1, 0, 0, 0, 0, loc).Unix()
+	case unitMon:
+		month := int64(d.Year())*12 + int64(d.Month()) - 1
+		month -= month % p.n
+		return time.Date(int(month/12), time.Month(month%12+1), 1, 0, 0, 0, 0, loc).Unix()
+	case unitWeek:
+		// 周一为一周的开始
+		monday := civilDay(d) - int64(d.Weekday()+6)%7
+		weeks := (monday - epochMonday) / 7
+		return dayStart(epochMonday+(weeks-weeks%p.n)*7, loc)
+	case unitDay:
+		day := civilDay(d)
+		return dayStart(day-day%p.n, loc)
+	}
+
+	return ts - ts%p.step()
+}
+
+// next start 开始的K线的下一根K线的开始时间
+func (p periodSpec) next(start int64, loc *time.Location) int64 {
+
+	d := time.Unix(start, 0).In(loc)
+
+	switch p.unit {
+	case unitYear:
+		return d.AddDate(int(p.n), 0, 0).Unix()
+	case unitMon:
+		return d.AddDate(0, int(p.n), 0).Unix()
+	case unitWeek:
+		return d.AddDate(0, 0, int(p.n)*7).Unix()
+	case unitDay:
+		return d.AddDate(0, 0, int(p.n)).Unix()
+	}
+
+	return start + p.step()
+}
+
+// nests p 的K线边界是否都是 to 的K线边界，即 to 的每根K线正好由整数根 p 的K线组成
+// 一天以内的周期合并成天以上的周期时，还要求当地零点是 p 的边界，和时区有关，见 aligned
+func (p periodSpec) nests(to periodSpec) bool {
+
+	if p == to || p.maxSeconds() >= to.maxSeconds() {
+		return false
+	}
+
+	switch p.unit {
+	case unitMin, unitHour:
+		if to.intraday() {
+			return to.step()%p.step() == 0
+		}
+		return secondsPerDay%p.step() == 0
+	case unitDay:
+		return (to.unit == unitDay && to.n%p.n == 0) || (p.n == 1 && to.unit != unitDay)
+	case unitWeek:
+		return to.unit == unitWeek && to.n%p.n == 0
+	case unitMon:
+		return (to.unit == unitMon && to.n%p.n == 0) || (to.unit == unitYear && 12%p.n == 0)
+	case unitYear:
+		return to.unit == unitYear && to.n%p.n == 0
+	}
+	return false
+}
+
+// aligned ts 是否是 p 的K线边界
+func (p periodSpec) aligned(ts int64, loc *time.Location) bool {
+	return p.start(ts, loc) == ts
+}
+
+// civilDay 当地日期距离 1970-01-01 的天数
+func civilDay(d time.Time) int64 {
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC).Unix() / secondsPerDay
+}
+
+// dayStart 距离 1970-01-01 day 天的日期在 loc 时区的零点
+func dayStart(day int64, loc *time.Location) int64 {
+	d := time.Unix(day*secondsPerDay, 0).UTC()
+	return time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc).Unix()
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"sync-kline/config"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func mustTime(t *testing.T, value string) int64 {
+	t.Helper()
+	d, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.Unix()
+}
+
+func TestPeriodStartNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		period string
+		ts     string
+		start  string
+		next   string
+	}{
+		// 一天以内的周期按 UTC 对齐，春季切换 2024-03-10 02:00 EST -> 03:00 EDT，当天 23 小时
+		{"spring 1hour before", "America/New_York", "1hour", "2024-03-10T01:30:00-05:00", "2024-03-10T01:00:00-05:00", "2024-03-10T03:00:00-04:00"},
+		{"spring 1hour after", "America/New_York", "1hour", "2024-03-10T03:30:00-04:00", "2024-03-10T03:00:00-04:00", "2024-03-10T04:00:00-04:00"},
+		{"spring 4hour before", "America/New_York", "4hour", "2024-03-10T01:30:00-05:00", "2024-03-09T23:00:00-05:00", "2024-03-10T04:00:00-04:00"},
+		{"spring 4hour after", "America/New_York", "4hour", "2024-03-10T06:30:00-04:00", "2024-03-10T04:00:00-04:00", "2024-03-10T08:00:00-04:00"},
+		{"spring 4hour midnight", "America/New_York", "4hour", "2024-03-10T22:00:00-04:00", "2024-03-10T20:00:00-04:00", "2024-03-11T00:00:00-04:00"},
+		{"spring 1day", "America/New_York", "1day", "2024-03-10T12:00:00-04:00", "2024-03-10T00:00:00-05:00", "2024-03-11T00:00:00-04:00"},
+		{"spring 1week", "America/New_York", "1week", "2024-03-10T12:00:00-04:00", "2024-03-04T00:00:00-05:00", "2024-03-11T00:00:00-04:00"},
+
+		// 秋季切换 2024-11-03 02:00 EDT -> 01:00 EST，当天 25 小时，01:00-02:00 出现两次
+		{"fall 1hour first", "America/New_York", "1hour", "2024-11-03T01:30:00-04:00", "2024-11-03T01:00:00-04:00", "2024-11-03T01:00:00-05:00"},
+		{"fall 1hour second", "America/New_York", "1hour", "2024-11-03T01:30:00-05:00", "2024-11-03T01:00:00-05:00", "2024-11-03T02:00:00-05:00"},
+		{"fall 4hour after", "America/New_York", "4hour", "2024-11-03T05:00:00-05:00", "2024-11-03T03:00:00-05:00", "2024-11-03T07:00:00-05:00"},
+		{"fall 4hour across midnight", "America/New_York", "4hour", "2024-11-03T23:30:00-05:00", "2024-11-03T23:00:00-05:00", "2024-11-04T03:00:00-05:00"},
+
+		// 半小时时区
+		{"kolkata 1hour", "Asia/Kolkata", "1hour", "2024-01-01T10:45:00+05:30", "2024-01-01T10:30:00+05:30", "2024-01-01T11:30:00+05:30"},
+		{"kolkata 1day", "Asia/Kolkata", "1day", "2024-01-01T10:45:00+05:30", "2024-01-01T00:00:00+05:30", "2024-01-02T00:00:00+05:30"},
+		{"fall 1day", "America/New_York", "1day", "2024-11-03T12:00:00-05:00", "2024-11-03T00:00:00-04:00", "2024-11-04T00:00:00-05:00"},
+		{"fall 1mon", "America/New_York", "1mon", "2024-11-03T12:00:00-05:00", "2024-11-01T00:00:00-04:00", "2024-12-01T00:00:00-05:00"},
+
+		// 跨年
+		{"year 4hour", "Asia/Shanghai", "4hour", "2023-12-31T22:30:00+08:00", "2023-12-31T20:00:00+08:00", "2024-01-01T00:00:00+08:00"},
+		{"year 1day", "UTC", "1day", "2023-12-31T23:59:59Z", "2023-12-31T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"year 3day", "UTC", "3day", "2024-01-01T08:00:00Z", "2023-12-31T00:00:00Z", "2024-01-03T00:00:00Z"},
+		{"year 1week sunday", "Asia/Shanghai", "1week", "2023-12-31T23:00:00+08:00", "2023-12-25T00:00:00+08:00", "2024-01-01T00:00:00+08:00"},
+		{"year 1week monday", "Asia/Shanghai", "1week", "2024-01-01T00:00:00+08:00", "2024-01-01T00:00:00+08:00", "2024-01-08T00:00:00+08:00"},
+		{"year 2week", "Asia/Shanghai", "2week", "2024-01-01T00:00:00+08:00", "2023-12-25T00:00:00+08:00", "2024-01-08T00:00:00+08:00"},
+		{"year 1mon", "Asia/Shanghai", "1mon", "2023-12-15T12:00:00+08:00", "2023-12-01T00:00:00+08:00", "2024-01-01T00:00:00+08:00"},
+		{"year 3mon", "Asia/Shanghai", "3mon", "2023-11-20T12:00:00+08:00", "2023-10-01T00:00:00+08:00", "2024-01-01T00:00:00+08:00"},
+		{"year 1year last second", "Asia/Shanghai", "1year", "2023-12-31T23:59:59+08:00", "2023-01-01T00:00:00+08:00", "2024-01-01T00:00:00+08:00"},
+		{"year 1year first second", "Asia/Shanghai", "1year", "2024-01-01T00:00:00+08:00", "2024-01-01T00:00:00+08:00", "2025-01-01T00:00:00+08:00"},
+		{"year 2year", "UTC", "2year", "2023-06-01T00:00:00Z", "2022-01-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+		// UTC 的跨年在上海已经是 1 月 1 日 8 点
+		{"year 1day zone", "Asia/Shanghai", "1day", "2023-12-31T23:00:00Z", "2024-01-01T00:00:00+08:00", "2024-01-02T00:00:00+08:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := mustLocation(t, tt.zone)
+			p, ok := parsePeriod(tt.period)
+			if !ok {
+				t.Fatalf("parsePeriod(%q) failed", tt.period)
+			}
+
+			start := p.start(mustTime(t, tt.ts), loc)
+			if want := mustTime(t, tt.start); start != want {
+				t.Errorf("start = %s, want %s", time.Unix(start, 0).In(loc), time.Unix(want, 0).In(loc))
+			}
+			next := p.next(start, loc)
+			if want := mustTime(t, tt.next); next != want {
+				t.Errorf("next = %s, want %s", time.Unix(next, 0).In(loc), time.Unix(want, 0).In(loc))
+			}
+		})
+	}
+}
+
+// 夏令时切换的那天每分钟所在的K线都是连续不重叠的，一天以内的周期和 UTC 的一样
+func TestPeriodContiguousOnDST(t *testing.T) {
+	loc := mustLocation(t, "America/New_York")
+	days := []string{"2024-03-10T00:00:00-05:00", "2024-11-03T00:00:00-04:00"}
+
+	for _, period := range []string{"1min", "15min", "1hour", "4hour", "12hour", "1day"} {
+		p, _ := parsePeriod(period)
+		for _, day := range days {
+			from := mustTime(t, day)
+			to := p.next(p.start(from+2*secondsPerDay, loc), loc)
+
+			prevEnd := p.start(from, loc)
+			for ts := prevEnd; ts < to; {
+				start := p.start(ts, loc)
+				next := p.next(start, loc)
+				if start != prevEnd || next <= start {
+					t.Fatalf("%s %s: [%d, %d) after %d", period, day, start, next, prevEnd)
+				}
+				if p.intraday() && (start != p.start(start, time.UTC) || next != p.next(start, time.UTC)) {
+					t.Fatalf("%s %s: [%d, %d) not aligned to UTC", period, day, start, next)
+				}
+				for probe := start; probe < next; probe += 60 {
+					if got := p.start(probe, loc); got != start {
+						t.Fatalf("%s: start(%d) = %d, want %d", period, probe, got, start)
+					}
+				}
+				prevEnd = next
+				ts = next
+			}
+		}
+	}
+}
+
+// 当地零点不在一天以内的周期的边界上时，天由更小的周期合并
+func TestRollupFrom(t *testing.T) {
+	periods := []string{"1min", "30min", "1hour", "4hour", "1day"}
+	tests := []struct {
+		zone string
+		day  string
+		want string
+	}{
+		{"UTC", "2024-01-01T00:00:00Z", "4hour"},
+		{"Asia/Shanghai", "2024-01-01T00:00:00+08:00", "4hour"},
+		{"Asia/Kolkata", "2024-01-01T00:00:00+05:30", "30min"},
+		{"America/New_York", "2024-01-01T00:00:00-05:00", "1hour"},
+	}
+	for _, tt := range tests {
+		s := &source{periods: periods, location: mustLocation(t, tt.zone)}
+		p, _ := parsePeriod("1day")
+		start := p.start(mustTime(t, tt.day), s.location)
+		if got := rollupFrom(s, "1day", start, p.next(start, s.location)); got != tt.want {
+			t.Errorf("%s: rollupFrom(1day) = %s, want %s", tt.zone, got, tt.want)
+		}
+	}
+}
+
+// 币安的历史K线按 UTC 切分，没有配置时区时使用 UTC，其它平台使用引擎的时区
+func TestSourceTimezone(t *testing.T) {
+	c, err := newEngine(nil, &config.MongoConfig{}, &config.EngineConfig{
+		Timezone: "Asia/Shanghai",
+		Sources: []config.SourceConfig{
+			{Platform: "huobi"},
+			{Platform: "binance"},
+			{Name: "okx_utc", Platform: "okx", Timezone: "UTC"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"huobi": "Asia/Shanghai", "binance": "UTC", "okx_utc": "UTC"}
+	for name, zone := range want {
+		if got := c.sourceLocation(name).String(); got != zone {
+			t.Errorf("%s location = %s, want %s", name, got, zone)
+		}
+	}
+
+	ts := mustTime(t, "2024-01-01T03:00:00+08:00")
+	if start, _ := klineCreateDateTime(ts, "1day", -1, c.sourceLocation("binance")); start != mustTime(t, "2023-12-31T00:00:00Z") {
+		t.Errorf("binance 1day start = %d", start)
+	}
+	if start, _ := klineCreateDateTime(ts, "1day", -1, c.sourceLocation("huobi")); start != mustTime(t, "2024-01-01T00:00:00+08:00") {
+		t.Errorf("huobi 1day start = %d", start)
+	}
+
+	_, err = newEngine(nil, &config.MongoConfig{}, &config.EngineConfig{
+		Sources: []config.SourceConfig{{Platform: "huobi", Timezone: "Mars/Olympus"}},
+	})
+	if err == nil {
+		t.Error("invalid timezone accepted")
+	}
+}
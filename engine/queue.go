@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync-kline/config"
+	"sync/atomic"
+)
+
+// 队列满时的处理方式
+const (
+	OverflowBlock      = "block"       // 等待引擎取走，读取推送的协程会阻塞，不能及时回复心跳
+	OverflowDropOldest = "drop_oldest" // 丢弃最早的成交
+	OverflowSpill      = "spill"       // 写入磁盘文件，内存队列取完后按顺序读回
+)
+
+// QueueStats 交易所推送到引擎之间的队列情况
+type QueueStats struct {
+	Overflow string `json:"overflow"` // 队列满时的处理方式
+	Pending  int    `json:"pending"`  // 等待引擎处理的成交，包括磁盘上的
+	Dropped  uint64 `json:"dropped"`  // 丢弃的成交
+	Spilled  uint64 `json:"spilled"`  // 写入过磁盘的成交
+}
+
+// tradeQueue 读取推送的协程写入，引擎按顺序取出，除了 block 之外写入都不会阻塞，没有配置时为 spill
+// spill 模式下磁盘上有数据时新的成交也写入磁盘，保证顺序
+type tradeQueue struct {
+	overflow  string
+	buffer    chan *TradeDetailCh
+	notify    chan struct{} // 写入磁盘后通知
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   uint64
+	spilled   uint64
+
+	mu        sync.Mutex // 保护磁盘文件
+	spillPath string
+	file      *os.File
+	readOff   int64
+	writeOff  int64
+	spillLen  int64
+}
+
+func newTradeQueue(name string, conf *config.QueueConfig) (*tradeQueue, error) {
+
+	overflow := conf.Overflow
+	if overflow == "" {
+		overflow = OverflowSpill
+	}
+	if overflow != OverflowBlock && overflow != OverflowDropOldest && overflow != OverflowSpill {
+		return nil, fmt.Errorf("不支持的队列溢出方式: %s", overflow)
+	}
+	if overflow == OverflowBlock {
+		fmt.Println(name, "队列满时等待，读取推送的协程不能及时回复心跳，可能被交易所断开")
+	}
+	size := conf.Size
+	if size <= 0 {
+		size = 1
+	}
+
+	return &tradeQueue{
+		overflow:  overflow,
+		buffer:    make(chan *TradeDetailCh, size),
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		spillPath: filepath.Join(conf.SpillDir, name+".spill"),
+	}, nil
+}
+
+// push 写入一笔成交，关闭之后丢弃
+func (q *tradeQueue) push(trade *TradeDetailCh) {
+
+	switch q.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.buffer <- trade:
+				return
+			default:
+			}
+			select {
+			case <-q.buffer:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+		}
+	case OverflowSpill:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.spillLen == 0 {
+			select {
+			case q.buffer <- trade:
+				return
+			default:
+			}
+		}
+		if err := q.spill(trade); err != nil {
+			fmt.Println("成交写入磁盘失败", q.spillPath, err)
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		}
+		atomic.AddUint64(&q.spilled, 1)
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	default:
+		select {
+		case q.buffer <- trade:
+		case <-q.done:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	}
+}
+
+// pop 按写入顺序取出，关闭并且取完后返回 false
+func (q *tradeQueue) pop() (*TradeDetailCh, bool) {
+
+	closing := false
+	for {
+		// 内存中的总是比磁盘上的早
+		select {
+		case trade := <-q.buffer:
+			return trade, true
+		default:
+		}
+
+		if trade, ok := q.unspill(); ok {
+			return trade, true
+		}
+		if closing {
+			return nil, false
+		}
+
+		select {
+		case trade := <-q.buffer:
+			return trade, true
+		case <-q.notify:
+		case <-q.done:
+			closing = true
+		}
+	}
+}
+
+// close 不再写入，已经写入的仍然可以取出
+func (q *tradeQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
+
+// spill 长度加 json 追加到文件末尾
+func (q *tradeQueue) spill(trade *TradeDetailCh) error {
+
+	if q.file == nil {
+		if err := os.MkdirAll(filepath.Dir(q.spillPath), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(q.spillPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		q.file = file
+	}
+
+	data, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	if _, err := q.file.WriteAt(record, q.writeOff); err != nil {
+		return err
+	}
+	q.writeOff += int64(len(record))
+	q.spillLen++
+	return nil
+}
+
+// unspill 读取磁盘上最早的一笔，全部读完后清空文件
+func (q *tradeQueue) unspill() (*TradeDetailCh, bool) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.spillLen > 0 {
+		trade, err := q.readSpill()
+		if q.spillLen == 0 {
+			q.readOff, q.writeOff = 0, 0
+			_ = q.file.Truncate(0)
+		}
+		if err != nil {
+			fmt.Println("读取磁盘上的成交失败", q.spillPath, err)
+			atomic.AddUint64(&q.dropped, 1)
+			continue
+		}
+		return trade, true
+	}
+	return nil, false
+}
+
+func (q *tradeQueue) readSpill() (*TradeDetailCh, error) {
+
+	var header [4]byte
+	if _, err := q.file.ReadAt(header[:], q.readOff); err != nil {
+		// 文件损坏，剩下的都读不出来
+		q.spillLen = 0
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := q.file.ReadAt(data, q.readOff+4); err != nil {
+		q.spillLen = 0
+		return nil, err
+	}
+	q.readOff += int64(4 + len(data))
+	q.spillLen--
+
+	var trade TradeDetailCh
+	if err := json.Unmarshal(data, &trade); err != nil {
+		return nil, fmt.Errorf("成交解析失败: %w", err)
+	}
+	return &trade, nil
+}
+
+// release 关闭并删除磁盘文件
+func (q *tradeQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file != nil {
+		_ = q.file.Close()
+		_ = os.Remove(q.spillPath)
+		q.file = nil
+	}
+}
+
+func (q *tradeQueue) stats() QueueStats {
+	q.mu.Lock()
+	spillLen := q.spillLen
+	q.mu.Unlock()
+
+	return QueueStats{
+		Overflow: q.overflow,
+		Pending:  len(q.buffer) + int(spillLen),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Spilled:  atomic.LoadUint64(&q.spilled),
+	}
+}
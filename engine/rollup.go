@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
+)
+
+const (
+	AggregationTrade  = "trade"  // 每个周期都由成交计算
+	AggregationRollup = "rollup" // 只有 1min 由成交计算，其它周期由低周期K线合并
+)
+
+// rollupBase 合并的基础周期
+const rollupBase = "1min"
+
+// rollupBatch rebuild 每批写入的K线数量
+const rollupBatch = 1000
+
+// rollupKey rollup 模式下一根高周期K线
+type rollupKey struct {
+	seriesKey
+	start int64
+}
+
+// rollupCandle rollup 模式下还没收盘的高周期K线，kLine 合并了 covered 之前收盘的 1min，之后的 1min 还在内存中
+type rollupCandle struct {
+	kLine   KLine
+	end     int64
+	covered int64
+}
+
+// rollup 1min K线收盘后，逐级重新计算包含它的高周期K线，只计算数据源配置的周期
+// closing 为 true 时合并到这根 1min 为止并记录高周期还没收盘的K线，到结束时间加 close_delay 后由 closeRollups 收盘，最后一分钟没有成交也会收盘
+// 调用时需要持有 flushMu
+func (c *ConCurrentEngine) rollup(s *source, pair string, ts int64, closing bool) {
+
+	name := s.name
+	_, minuteEnd := klineCreateDateTime(ts, rollupBase, -1, s.location)
+	for _, period := range s.periods {
+		if period == rollupBase {
+			continue
+		}
+		start, next := klineCreateDateTime(ts, period, -1, s.location)
+		key := rollupKey{seriesKey: seriesKey{name: name, symbol: pair, period: period}, start: start}
+
+		// 数据库中的高周期只合并收盘的 1min，还没收盘的在推送时从内存中加上
+		to := next
+		if closing {
+			to = minuteEnd
+		}
+		c.rollupMu.Lock()
+		if open, ok := c.rollups[key]; ok && (!closing || open.covered > to) {
+			to = open.covered
+		}
+		c.rollupMu.Unlock()
+
+		kLine, err := c.rollupRange(name, pair, rollupFrom(s, period, start, next), start, to)
+		if err != nil {
+			fmt.Println("合并K线失败", name, pair, period, err)
+			return
+		}
+		if kLine == nil {
+			continue
+		}
+		kLine.Time = start
+
+		if err := c.replaceKLines(name, pair, period, []*KLine{kLine}); err != nil {
+			fmt.Println("合并K线失败", name, pair, period, err)
+			return
+		}
+
+		c.rollupMu.Lock()
+		if open, ok := c.rollups[key]; ok {
+			if to >= open.covered {
+				open.kLine = *kLine
+				open.covered = to
+			}
+		} else if closing {
+			c.rollups[key] = &rollupCandle{kLine: *kLine, end: next, covered: to}
+		}
+		c.rollupMu.Unlock()
+
+		if view := c.rollupView(key); view != nil {
+			kLine = view
+		}
+		c.emitCandleUpdate(name, pair, period, kLine)
+	}
+}
+
+// rollupUpdate rollup 模式下 1min 有变动时推送包含它的高周期K线，不写入数据库
+// 高周期第一次变动时从数据库合并之前收盘的 1min，已经到时间收盘的不再推送，迟到的成交由 flush 中的 rollup 更新
+func (c *ConCurrentEngine) rollupUpdate(s *source, pair string, minute int64) {
+
+	expired := time.Now().Add(-c.closeDelay).Unix()
+	for _, period := range s.periods {
+		if period == rollupBase {
+			continue
+		}
+		start, next := klineCreateDateTime(minute, period, -1, s.location)
+		if next <= expired {
+			continue
+		}
+		key := rollupKey{seriesKey: seriesKey{name: s.name, symbol: pair, period: period}, start: start}
+
+		c.rollupMu.Lock()
+		_, ok := c.rollups[key]
+		c.rollupMu.Unlock()
+		if !ok {
+			kLine, err := c.rollupRange(s.name, pair, rollupFrom(s, period, start, next), start, minute)
+			if err != nil {
+				fmt.Println("合并K线失败", s.name, pair, period, err)
+				continue
+			}
+			item := &rollupCandle{end: next, covered: minute}
+			if kLine != nil {
+				item.kLine = *kLine
+			}
+			item.kLine.Time = start
+
+			c.rollupMu.Lock()
+			if _, ok := c.rollups[key]; !ok {
+				c.rollups[key] = item
+			}
+			c.rollupMu.Unlock()
+		}
+
+		if view := c.rollupView(key); view != nil {
+			c.emitCandleUpdate(s.name, pair, period, view)
+		}
+	}
+}
+
+// rollupView 还没收盘的高周期K线加上内存中 covered 之后的 1min，没有记录时返回 nil
+func (c *ConCurrentEngine) rollupView(key rollupKey) *KLine {
+
+	c.rollupMu.Lock()
+	open, ok := c.rollups[key]
+	if !ok {
+		c.rollupMu.Unlock()
+		return nil
+	}
+	view := open.kLine
+	covered, end := open.covered, open.end
+	c.rollupMu.Unlock()
+
+	base := seriesKey{name: key.name, symbol: key.symbol, period: rollupBase}
+	c.aggregator.mergeRange(base, covered, end, &view)
+	view.Time = key.start
+	return &view
+}
+
+// closeRollups 结束时间早于 now 的高周期K线收盘，没有成交的 1min 不会收盘，按时间检查
+func (c *ConCurrentEngine) closeRollups(now int64) {
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.closeRollupsLocked(now)
+}
+
+func (c *ConCurrentEngine) closeRollupsLocked(now int64) {
+
+	var keys []rollupKey
+	kLines := make(map[rollupKey]KLine)
+	c.rollupMu.Lock()
+	for key, open := range c.rollups {
+		if open.end <= now {
+			keys = append(keys, key)
+			kLines[key] = open.kLine
+			delete(c.rollups, key)
+		}
+	}
+	c.rollupMu.Unlock()
+
+	// 同一个序列按时间顺序收盘，没有成交的不通知
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].start < keys[j].start
+	})
+	for _, key := range keys {
+		kLine := kLines[key]
+		if kLine.Count == 0 {
+			continue
+		}
+		c.emitCandleClose(key.name, key.symbol, key.period, &kLine)
+	}
+}
+
+// rollupFrom 由已同步的最大的能整除的低周期合并 [start, next) 的K线，如 1hour 由 30min 合并，没有同步 30min 时由 15min 合并
+// 一天以内的周期按 UTC 对齐，当地零点不在它的边界上时（如 Asia/Kolkata 的 1hour）不能合并成天
+// s.periods 从低到高排序，前面的周期已经合并好了
+func rollupFrom(s *source, period string, start int64, next int64) string {
+	to, _ := parsePeriod(period)
+	from := rollupBase
+	for _, item := range s.periods {
+		p, _ := parsePeriod(item)
+		if p.nests(to) && p.aligned(start, s.location) && p.aligned(next, s.location) {
+			from = item
+		}
+	}
+	return from
+}
+
+// rollupRange 合并 [from, to) 之间的K线，没有数据返回 nil
+func (c *ConCurrentEngine) rollupRange(name string, pair string, period string, from int64, to int64) (*KLine, error) {
+
+	findOptions := options.Find().SetSort(bson.M{"time": 1})
+	cur, err := c.KLineCollection(name, pair, period).Find(context.TODO(), bson.M{"time": bson.M{"$gte": from, "$lt": to}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+
+	var kLine *KLine
+	for cur.Next(context.TODO()) {
+		var item KLine
+		if err := cur.Decode(&item); err != nil {
+			return nil, err
+		}
+		if kLine == nil {
+			kLine = &KLine{}
+		}
+		klineMerge(kLine, &item)
+	}
+
+	return kLine, cur.Err()
+}
+
+// Rebuild 用 1min K线重新生成 period 在 [from, to) 之间的K线，to 为 0 表示到最新
+// from、to 会扩展到所在K线的开始和结束
+func (c *ConCurrentEngine) Rebuild(name string, pair string, period string, from int64, to int64) error {
+
+	s := c.source(name)
+	if s == nil {
+		return fmt.Errorf("数据源不存在: %s", name)
+	}
+	standard, ok := standardPeriod(period)
+	if !ok || standard == rollupBase {
+		return fmt.Errorf("不支持的周期: %s", period)
+	}
+	if !s.hasPeriod(standard) || !s.hasPeriod(rollupBase) {
+		return fmt.Errorf("数据源 %s 没有同步周期 %s", name, period)
+	}
+	period = standard
+
+	from, _ = klineCreateDateTime(from, period, 1, s.location)
+	filter := bson.M{"$gte": from}
+	if to > 0 {
+		_, to = klineCreateDateTime(to-1, period, -1, s.location)
+		filter["$lt"] = to
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"time": 1})
+	cur, err := c.KLineCollection(name, pair, rollupBase).Find(context.TODO(), bson.M{"time": filter}, findOptions)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.TODO())
+
+	var batch []*KLine
+	var kLine *KLine
+	for cur.Next(context.TODO()) {
+		var item KLine
+		if err := cur.Decode(&item); err != nil {
+			return err
+		}
+
+		start, _ := klineCreateDateTime(item.Time, period, 1, s.location)
+		if kLine == nil || kLine.Time != start {
+			if kLine != nil {
+				batch = append(batch, kLine)
+			}
+			kLine = &KLine{}
+		}
+		klineMerge(kLine, &item)
+		kLine.Time = start
+
+		if len(batch) >= rollupBatch {
+			if err := c.replaceKLines(name, pair, period, batch); err != nil {
+				return err
+			}
+			fmt.Printf("%s交易对：%s -- %s 已重新生成到 %s\n", name, pair, period, time.Unix(kLine.Time, 0).In(s.location).Format("2006-01-02 15:04:05"))
+			batch = nil
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	if kLine != nil {
+		batch = append(batch, kLine)
+	}
+
+	return c.replaceKLines(name, pair, period, batch)
+}
+
+// klineMerge 把按时间升序的低周期K线合并到高周期K线
+func klineMerge(dst *KLine, src *KLine) {
+
+	if fromDecimal128(dst.Open).Cmp(decimal0) <= 0 {
+		dst.Open = src.Open
+		dst.Low = src.Low
+		dst.High = src.High
+	} else {
+		if low := fromDecimal128(src.Low); low.Cmp(decimal0) > 0 && low.Cmp(fromDecimal128(dst.Low)) < 0 {
+			dst.Low = src.Low
+		}
+		if fromDecimal128(src.High).Cmp(fromDecimal128(dst.High)) > 0 {
+			dst.High = src.High
+		}
+	}
+	dst.Close = src.Close
+
+	dst.Amount = toDecimal128(fromDecimal128(dst.Amount).Add(fromDecimal128(src.Amount)))
+	dst.Vol = toDecimal128(fromDecimal128(dst.Vol).Add(fromDecimal128(src.Vol)))
+	dst.Count += src.Count
+	dst.BuyAmount = toDecimal128(fromDecimal128(dst.BuyAmount).Add(fromDecimal128(src.BuyAmount)))
+	dst.SellAmount = toDecimal128(fromDecimal128(dst.SellAmount).Add(fromDecimal128(src.SellAmount)))
+	dst.BuyVol = toDecimal128(fromDecimal128(dst.BuyVol).Add(fromDecimal128(src.BuyVol)))
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"github.com/shopspring/decimal"
+	"sync-kline/config"
+	"testing"
+	"time"
+)
+
+type closeRecorder struct {
+	closed  []string
+	updates map[string]KLine
+}
+
+func (r *closeRecorder) OnTrade(name string, trade *TradeDetailCh) {}
+
+func (r *closeRecorder) OnCandleUpdate(name string, symbol string, period string, kLine *KLine) {
+	if r.updates == nil {
+		r.updates = make(map[string]KLine)
+	}
+	r.updates[period] = *kLine
+}
+
+func (r *closeRecorder) OnCandleClose(name string, symbol string, period string, kLine *KLine) {
+	r.closed = append(r.closed, period)
+}
+
+// 最后一分钟没有成交时，高周期到时间也收盘
+func TestCloseRollups(t *testing.T) {
+	c, err := newEngine(nil, &config.MongoConfig{}, &config.EngineConfig{
+		Timezone:    "UTC",
+		Aggregation: AggregationRollup,
+		Sources:     []config.SourceConfig{{Platform: "huobi", Periods: []string{"1min", "5min", "1hour"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &closeRecorder{}
+	c.AddSink(recorder)
+
+	// 最后一根 1min 在 [180, 240)，5min 在 300 结束
+	c.rollups[rollupKey{seriesKey: seriesKey{name: "huobi", symbol: "btcusdt", period: "5min"}}] = &rollupCandle{kLine: KLine{Count: 1}, end: 300}
+	c.rollups[rollupKey{seriesKey: seriesKey{name: "huobi", symbol: "btcusdt", period: "1hour"}}] = &rollupCandle{kLine: KLine{Count: 1}, end: 3600}
+	// 没有成交的不通知收盘
+	c.rollups[rollupKey{seriesKey: seriesKey{name: "huobi", symbol: "ethusdt", period: "5min"}}] = &rollupCandle{end: 300}
+
+	c.closeRollups(299)
+	if len(recorder.closed) != 0 {
+		t.Fatalf("closed before end: %v", recorder.closed)
+	}
+	c.closeRollups(300)
+	if len(recorder.closed) != 1 || recorder.closed[0] != "5min" {
+		t.Fatalf("closed = %v, want [5min]", recorder.closed)
+	}
+	c.closeRollups(301)
+	if len(recorder.closed) != 1 {
+		t.Fatalf("5min closed twice: %v", recorder.closed)
+	}
+	c.closeRollups(3600)
+	if len(recorder.closed) != 2 || recorder.closed[1] != "1hour" || len(c.rollups) != 0 {
+		t.Fatalf("closed = %v, open = %d", recorder.closed, len(c.rollups))
+	}
+}
+
+// 1min 有变动时，高周期由已经收盘的部分加上内存中的 1min 合并推送
+func TestRollupUpdate(t *testing.T) {
+	c, err := newEngine(nil, &config.MongoConfig{}, &config.EngineConfig{
+		Timezone:    "UTC",
+		Aggregation: AggregationRollup,
+		Sources:     []config.SourceConfig{{Platform: "huobi", Periods: []string{"1min", "5min"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &closeRecorder{}
+	c.AddSink(recorder)
+
+	s := c.source("huobi")
+	start := time.Now().Unix() / 300 * 300
+	key := rollupKey{seriesKey: seriesKey{name: "huobi", symbol: "btcusdt", period: "5min"}, start: start}
+
+	// 前两分钟已经收盘合并
+	closed := KLine{Time: start}
+	klineAddTrade(&closed, decimal.NewFromInt(100), decimal.NewFromInt(2), SideBuy)
+	closed.Count = 3
+	c.rollups[key] = &rollupCandle{kLine: closed, end: start + 300, covered: start + 120}
+
+	base := seriesKey{name: "huobi", symbol: "btcusdt", period: rollupBase}
+	mark := dedupKey{name: "huobi", symbol: "btcusdt"}
+	for i, price := range []int64{90, 120} {
+		minute := start + 120 + int64(i)*60
+		u := candleUpdate{key: base, ts: minute, end: minute + 60}
+		c.aggregator.apply([]candleUpdate{u}, mark, 0, 0, decimal.NewFromInt(price), decimal.NewFromInt(1), SideSell)
+	}
+	// 已经合并过的 1min 还在内存中时不重复计算
+	old := candleUpdate{key: base, ts: start + 60, end: start + 120}
+	c.aggregator.apply([]candleUpdate{old}, mark, 0, 0, decimal.NewFromInt(50), decimal.NewFromInt(1), SideSell)
+
+	c.rollupUpdate(s, "btcusdt", start+180)
+
+	got, ok := recorder.updates["5min"]
+	if !ok {
+		t.Fatal("5min update not emitted")
+	}
+	if got.Time != start || got.Count != 5 {
+		t.Fatalf("time = %d count = %d, want %d 5", got.Time, got.Count, start)
+	}
+	checks := []struct {
+		name string
+		got  decimal.Decimal
+		want string
+	}{
+		{"open", fromDecimal128(got.Open), "100"},
+		{"close", fromDecimal128(got.Close), "120"},
+		{"low", fromDecimal128(got.Low), "90"},
+		{"high", fromDecimal128(got.High), "120"},
+		{"amount", fromDecimal128(got.Amount), "4"},
+		{"sell_amount", fromDecimal128(got.SellAmount), "2"},
+	}
+	for _, check := range checks {
+		if check.got.String() != check.want {
+			t.Errorf("%s = %s, want %s", check.name, check.got, check.want)
+		}
+	}
+	// 推送不改变已经收盘的部分
+	if c.rollups[key].kLine.Count != 3 {
+		t.Fatalf("tracked count = %d, want 3", c.rollups[key].kLine.Count)
+	}
+}
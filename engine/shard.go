@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardTrade 等待聚合的成交
+type shardTrade struct {
+	source   *source
+	trade    *TradeDetailCh
+	seq      uint64 // wal 序号，没有写入 wal 时为 0
+	received time.Time
+}
+
+// shard 聚合分片，同一个交易对的成交总是分到同一个分片，按收到的顺序处理
+// 队列满时放入会等待，读取成交的协程不再从 worker 取，成交留在 worker 的队列中按溢出方式处理
+type shard struct {
+	id        int
+	capacity  int
+	qmu       sync.Mutex // 保护 items、closed
+	notEmpty  *sync.Cond
+	notFull   *sync.Cond
+	items     []shardTrade
+	closed    bool
+	blocked   uint64
+	processed uint64
+	lag       int64 // 最近一笔成交从收到到处理完的纳秒数
+	maxLag    int64
+	mu        sync.Mutex
+	symbols   map[string]int64 // 交易对最近一笔成交的延迟（纳秒）
+}
+
+// ShardStats 分片的处理情况，延迟一直增大说明分片里的交易对处理不过来
+type ShardStats struct {
+	Shard     int              `json:"shard"`     // 分片
+	Pending   int              `json:"pending"`   // 队列中等待处理的成交
+	Capacity  int              `json:"capacity"`  // 队列长度
+	Blocked   uint64           `json:"blocked"`   // 队列满时等待的次数，一直增大说明聚合跟不上
+	Processed uint64           `json:"processed"` // 已处理的成交
+	Lag       int64            `json:"lag"`       // 最近一笔成交从收到到处理完的毫秒数
+	MaxLag    int64            `json:"max_lag"`   // 启动以来最大的延迟（毫秒）
+	Symbols   map[string]int64 `json:"symbols"`   // 分到该分片的交易对（数据源.交易对）最近一笔成交的延迟（毫秒）
+}
+
+func newShards(n int, size int) []*shard {
+	if n <= 0 {
+		n = 1
+	}
+	if size <= 0 {
+		size = 1
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		sh := &shard{
+			id:       i,
+			capacity: size,
+			symbols:  make(map[string]int64),
+		}
+		sh.notEmpty = sync.NewCond(&sh.qmu)
+		sh.notFull = sync.NewCond(&sh.qmu)
+		shards[i] = sh
+	}
+	return shards
+}
+
+// shardFor 按数据源和交易对选择分片
+func (c *ConCurrentEngine) shardFor(name string, symbol string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name + "." + normalizeSymbol(symbol)))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// dispatch 成交放入所在分片的队列，队列满时等待，返回 false 说明分片已经关闭，成交没有放入
+func (c *ConCurrentEngine) dispatch(s *source, trade *TradeDetailCh, seq uint64) bool {
+	item := shardTrade{source: s, trade: trade, seq: seq, received: time.Now()}
+	return c.shardFor(s.name, trade.Symbol).push(item)
+}
+
+// push 放入队列，队列满时等待，已经关闭时返回 false
+func (sh *shard) push(item shardTrade) bool {
+	sh.qmu.Lock()
+	defer sh.qmu.Unlock()
+
+	if !sh.closed && len(sh.items) >= sh.capacity {
+		atomic.AddUint64(&sh.blocked, 1)
+		for !sh.closed && len(sh.items) >= sh.capacity {
+			sh.notFull.Wait()
+		}
+	}
+	if sh.closed {
+		return false
+	}
+	sh.items = append(sh.items, item)
+	sh.notEmpty.Signal()
+	return true
+}
+
+// pop 按放入的顺序取出，关闭并且取完后返回 false
+func (sh *shard) pop() (shardTrade, bool) {
+	sh.qmu.Lock()
+	defer sh.qmu.Unlock()
+
+	for len(sh.items) == 0 {
+		if sh.closed {
+			return shardTrade{}, false
+		}
+		sh.notEmpty.Wait()
+	}
+	item := sh.items[0]
+	sh.items[0] = shardTrade{}
+	sh.items = sh.items[1:]
+	sh.notFull.Broadcast()
+	return item, true
+}
+
+// close 不再放入，已经放入的仍然会处理
+func (sh *shard) close() {
+	sh.qmu.Lock()
+	sh.closed = true
+	sh.qmu.Unlock()
+
+	sh.notEmpty.Broadcast()
+	sh.notFull.Broadcast()
+}
+
+func (sh *shard) pending() int {
+	sh.qmu.Lock()
+	defer sh.qmu.Unlock()
+	return len(sh.items)
+}
+
+// runShard 按顺序聚合分片中的成交，队列关闭并且处理完后返回
+func (c *ConCurrentEngine) runShard(sh *shard) {
+
+	defer c.shardWg.Done()
+
+	for {
+		item, ok := sh.pop()
+		if !ok {
+			return
+		}
+		s, trade := item.source, item.trade
+
+		c.emitTrade(s.name, trade)
+
+		c.applyTrade(s.name, trade, c.tradePeriods(s), item.seq)
+
+		sh.record(s.name+"."+normalizeSymbol(trade.Symbol), time.Since(item.received))
+	}
+}
+
+func (sh *shard) record(symbol string, lag time.Duration) {
+	atomic.AddUint64(&sh.processed, 1)
+	atomic.StoreInt64(&sh.lag, int64(lag))
+	for {
+		max := atomic.LoadInt64(&sh.maxLag)
+		if int64(lag) <= max || atomic.CompareAndSwapInt64(&sh.maxLag, max, int64(lag)) {
+			break
+		}
+	}
+
+	sh.mu.Lock()
+	sh.symbols[symbol] = int64(lag)
+	sh.mu.Unlock()
+}
+
+func (sh *shard) stats() ShardStats {
+	sh.mu.Lock()
+	symbols := make(map[string]int64, len(sh.symbols))
+	for symbol, lag := range sh.symbols {
+		symbols[symbol] = lag / int64(time.Millisecond)
+	}
+	sh.mu.Unlock()
+
+	return ShardStats{
+		Shard:     sh.id,
+		Pending:   sh.pending(),
+		Capacity:  sh.capacity,
+		Blocked:   atomic.LoadUint64(&sh.blocked),
+		Processed: atomic.LoadUint64(&sh.processed),
+		Lag:       atomic.LoadInt64(&sh.lag) / int64(time.Millisecond),
+		MaxLag:    atomic.LoadInt64(&sh.maxLag) / int64(time.Millisecond),
+		Symbols:   symbols,
+	}
+}
+
+// ShardStats 所有分片的处理情况
+func (c *ConCurrentEngine) ShardStats() []ShardStats {
+	stats := make([]ShardStats, len(c.shards))
+	for i, sh := range c.shards {
+		stats[i] = sh.stats()
+	}
+	return stats
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// 队列满时等待取出，不丢弃
+func TestShardPushBlocksWhenFull(t *testing.T) {
+	sh := newShards(1, 2)[0]
+
+	for i := 1; i <= 2; i++ {
+		if !sh.push(shardTrade{seq: uint64(i)}) {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- sh.push(shardTrade{seq: 3})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if item, ok := sh.pop(); !ok || item.seq != 1 {
+		t.Fatalf("pop = %d %v, want 1", item.seq, ok)
+	}
+	if ok := <-pushed; !ok {
+		t.Fatal("blocked push failed")
+	}
+	if stats := sh.stats(); stats.Blocked != 1 || stats.Pending != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	sh.close()
+	for _, want := range []uint64{2, 3} {
+		if item, ok := sh.pop(); !ok || item.seq != want {
+			t.Fatalf("pop = %d %v, want %d", item.seq, ok, want)
+		}
+	}
+	if _, ok := sh.pop(); ok {
+		t.Fatal("pop after close and drain succeeded")
+	}
+}
+
+// 关闭时唤醒等待的 push，成交没有放入
+func TestShardCloseReleasesPush(t *testing.T) {
+	sh := newShards(1, 1)[0]
+	sh.push(shardTrade{seq: 1})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- sh.push(shardTrade{seq: 2})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sh.close()
+
+	select {
+	case ok := <-pushed:
+		if ok {
+			t.Fatal("push after close succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after close")
+	}
+	if item, ok := sh.pop(); !ok || item.seq != 1 {
+		t.Fatalf("pop = %d %v, want 1", item.seq, ok)
+	}
+}
@@ -0,0 +1,35 @@
+package engine
+
+// Sink 接收成交和K线事件，在各个聚合分片和写入协程中并发同步调用，不能阻塞
+// 同一个交易对的事件按顺序调用
+type Sink interface {
+	// OnTrade 收到一笔成交
+	OnTrade(name string, trade *TradeDetailCh)
+	// OnCandleUpdate K线有变动，包括收盘后迟到的成交
+	OnCandleUpdate(name string, symbol string, period string, kLine *KLine)
+	// OnCandleClose K线收盘，每根K线只通知一次，没有成交时到时间也会收盘
+	OnCandleClose(name string, symbol string, period string, kLine *KLine)
+}
+
+// AddSink 添加事件接收，需要在 Start 之前调用
+func (c *ConCurrentEngine) AddSink(sink Sink) {
+	c.sinks = append(c.sinks, sink)
+}
+
+func (c *ConCurrentEngine) emitTrade(name string, trade *TradeDetailCh) {
+	for _, sink := range c.sinks {
+		sink.OnTrade(name, trade)
+	}
+}
+
+func (c *ConCurrentEngine) emitCandleUpdate(name string, symbol string, period string, kLine *KLine) {
+	for _, sink := range c.sinks {
+		sink.OnCandleUpdate(name, symbol, period, kLine)
+	}
+}
+
+func (c *ConCurrentEngine) emitCandleClose(name string, symbol string, period string, kLine *KLine) {
+	for _, sink := range c.sinks {
+		sink.OnCandleClose(name, symbol, period, kLine)
+	}
+}
@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	walSuffix      = ".wal"
+	walCheckpoint  = "checkpoint"
+	walHeaderSize  = 8 // 长度 + crc32
+	walMaxRecord   = 1 << 20
+	walSegmentUnit = 1 << 20 // segment_size 的单位 MB
+)
+
+var errWalCorrupt = errors.New("wal 记录损坏")
+
+// walRecord 一笔收到的成交，seq 全局递增
+type walRecord struct {
+	Seq    uint64         `json:"seq"`
+	Source string         `json:"source"`
+	Trade  *TradeDetailCh `json:"trade"`
+}
+
+type walSegment struct {
+	first uint64 // 第一条记录的序号，也是文件名
+	path  string
+}
+
+// tradeWal 聚合之前把成交追加写入本地文件，K线写入数据库后推进 checkpoint，
+// checkpoint 之前的分段文件删除；启动时重新聚合 checkpoint 之后的成交
+// 数据库不可用时 checkpoint 不推进，恢复并写入成功后才删除；期间退出的话下次启动重新聚合
+// 每条记录为 4 字节长度、4 字节 crc32 加 json，分段文件超过 segmentSize 后写入新的文件
+type tradeWal struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []walSegment
+	file        *os.File // 正在写入的分段，启动后第一次写入时创建
+	fileSize    int64
+	seq         uint64          // 最后一条记录的序号
+	pending     []uint64        // 已经写入还没有聚合完的序号，从小到大
+	done        map[uint64]bool // pending 中已经聚合完的
+	checkpoint  uint64          // 小于等于 checkpoint 的成交已经写入数据库
+}
+
+// openWal 打开目录，读取 checkpoint 和已有的分段
+func openWal(dir string, segmentSize int) (*tradeWal, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if segmentSize <= 0 {
+		segmentSize = 64
+	}
+
+	w := &tradeWal{
+		dir:         dir,
+		segmentSize: int64(segmentSize) * walSegmentUnit,
+		done:        make(map[uint64]bool),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, walCheckpoint))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		w.checkpoint, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("wal checkpoint 有误: %w", err)
+		}
+	}
+	w.seq = w.checkpoint
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, walSegment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].first < w.segments[j].first
+	})
+
+	return w, nil
+}
+
+// replay 按顺序读取 checkpoint 之后的成交，需要在 append 之前调用
+// 损坏的记录跳过，分段文件中损坏位置之后的记录无法读取
+func (w *tradeWal) replay(fn func(seq uint64, name string, trade *TradeDetailCh)) (int, error) {
+
+	w.mu.Lock()
+	segments := append([]walSegment(nil), w.segments...)
+	checkpoint := w.checkpoint
+	w.mu.Unlock()
+
+	count := 0
+	for _, segment := range segments {
+		err := readWalSegment(segment.path, func(record *walRecord) {
+			w.mu.Lock()
+			if record.Seq > w.seq {
+				w.seq = record.Seq
+			}
+			if record.Seq <= checkpoint {
+				w.mu.Unlock()
+				return
+			}
+			w.pending = append(w.pending, record.Seq)
+			w.mu.Unlock()
+
+			count++
+			fn(record.Seq, record.Source, record.Trade)
+		})
+		if errors.Is(err, errWalCorrupt) {
+			fmt.Println("wal 分段损坏，跳过后面的记录", segment.path, err)
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func readWalSegment(path string, fn func(record *walRecord)) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			// 最后一条只写了一部分
+			return fmt.Errorf("%w: %v", errWalCorrupt, err)
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+		if size > walMaxRecord {
+			return fmt.Errorf("%w: 长度 %d", errWalCorrupt, size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return fmt.Errorf("%w: %v", errWalCorrupt, err)
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return fmt.Errorf("%w: crc32 不一致", errWalCorrupt)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil || record.Trade == nil {
+			// 校验通过但是解析不了，只跳过这一条
+			continue
+		}
+		fn(&record)
+	}
+}
+
+// append 写入一笔成交，返回序号
+func (w *tradeWal) append(name string, trade *TradeDetailCh) (uint64, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq := w.seq + 1
+	payload, err := json.Marshal(walRecord{Seq: seq, Source: name, Trade: trade})
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:walHeaderSize], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	if w.file == nil || w.fileSize >= w.segmentSize {
+		if err := w.rotate(seq); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(record)
+	w.fileSize += int64(n)
+	if err != nil {
+		// 可能只写了一部分，之后写入新的分段，避免后面的记录读不出来
+		_ = w.file.Close()
+		w.file = nil
+		return 0, err
+	}
+
+	w.seq = seq
+	w.pending = append(w.pending, seq)
+	return seq, nil
+}
+
+// rotate 关闭当前分段，从 first 开始写新的分段
+func (w *tradeWal) rotate(first uint64) error {
+
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+
+	path := filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, walSuffix))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.fileSize = info.Size()
+	w.segments = append(w.segments, walSegment{first: first, path: path})
+	return nil
+}
+
+// applied 成交已经合并到内存中的K线
+func (w *tradeWal) applied(seq uint64) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.done[seq] = true
+	for len(w.pending) > 0 && w.done[w.pending[0]] {
+		delete(w.done, w.pending[0])
+		w.pending = w.pending[1:]
+	}
+}
+
+// mark 小于等于返回值的成交都已经合并到内存中的K线，需要和取出增量在同一个锁内调用
+func (w *tradeWal) mark() uint64 {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 {
+		return w.pending[0] - 1
+	}
+	return w.seq
+}
+
+// sync 写入磁盘
+func (w *tradeWal) sync() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// commit K线写入数据库后保存 checkpoint，删除全部在 checkpoint 之前的分段
+func (w *tradeWal) commit(mark uint64) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if mark <= w.checkpoint {
+		return nil
+	}
+
+	path := filepath.Join(w.dir, walCheckpoint)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(mark, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	w.checkpoint = mark
+
+	// 下一个分段从 mark 之后开始，说明这个分段的记录都在 checkpoint 之前
+	for len(w.segments) > 1 && w.segments[1].first <= mark+1 {
+		if err := os.Remove(w.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	return nil
+}
+
+// close 写入磁盘并关闭
+func (w *tradeWal) close() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// replayWal 重新聚合上次退出时没有写入数据库的成交，分片满时等待，不会丢弃
+// 保存的成交 ID 和 checkpoint 取自同一次写入，先于 checkpoint 保存，
+// 成交 ID 已经保存而 checkpoint 还没保存时，小于等于保存的 ID 的成交已经写入，跳过；
+// 部分集合写入失败时 checkpoint 不推进，已经写入的K线按 WalSeq 跳过，见 updateLocked
+func (c *ConCurrentEngine) replayWal() error {
+
+	count, err := c.wal.replay(func(seq uint64, name string, trade *TradeDetailCh) {
+		s := c.source(name)
+		if s == nil || c.dedup.seen(name, trade.Symbol, trade.TradeId) {
+			c.wal.applied(seq)
+			return
+		}
+		if c.dispatch(s, trade, seq) {
+			c.dedup.record(name, trade.Symbol, trade.TradeId)
+		}
+	})
+	if count > 0 {
+		fmt.Println("重新聚合 wal 中的成交", count)
+	}
+	return err
+}
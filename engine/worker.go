@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Worker 交易所连接，Start 之后从 Trades 读取成交，ctx 取消或者 Close 后 Trades 关闭
+// HistoryKlineBefore 返回空表示这一段时间没有K线（如暂停交易），没有更早的K线时返回 ErrHistoryStart
+type Worker interface {
+	Start(ctx context.Context) error
+	Close() error
+	State() ConnState
+	Reconnection() int
+	OnReconnect(handler func())
+	WriteMessage(msg []byte) error
+	Subscribe(ctx context.Context, symbol string) error
+	Trades() <-chan *TradeDetailCh
+	Errors() <-chan error
+	QueueStats() QueueStats
+	HistoryKline(symbol string, period string) ([]*KLine, error)
+	HistoryKlineBefore(symbol string, period string, before int64) ([]*KLine, error)
+}
+
+// 出错的操作
+const (
+	OpDial      = "dial"
+	OpRead      = "read"
+	OpWrite     = "write"
+	OpSubscribe = "subscribe"
+	OpDecode    = "decode"
+)
+
+var (
+	ErrWorkerStarted = errors.New("worker 已经启动")
+	ErrWorkerClosed  = errors.New("worker 已经关闭")
+)
+
+// workerErrorBuffer 错误通道的缓冲，没有读取时丢弃，不影响采集
+const workerErrorBuffer = 100
+
+// WorkerError worker 运行中的错误，可以用 errors.Is 判断原因
+type WorkerError struct {
+	Platform string
+	Op       string
+	Symbol   string // 和交易对无关时为空
+	Err      error
+}
+
+func (e *WorkerError) Error() string {
+	if e.Symbol == "" {
+		return fmt.Sprintf("%s %s: %v", e.Platform, e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s %s: %v", e.Platform, e.Op, e.Symbol, e.Err)
+}
+
+func (e *WorkerError) Unwrap() error {
+	return e.Err
+}
+
+// ExchangeError 交易所返回的错误
+type ExchangeError struct {
+	Code string
+	Msg  string
+}
+
+func (e *ExchangeError) Error() string {
+	return fmt.Sprintf("%s %s", e.Code, e.Msg)
+}
+
+// workerBase 各个交易所 worker 公共的部分：连接、订阅的交易对、成交和错误通道
+type workerBase struct {
+	platform     string
+	conn         *wsConn
+	subscribeMsg func(symbol string) ([]byte, error) // 订阅成交的消息
+	mu           sync.Mutex
+	symbols      []string
+	queue        *tradeQueue         // 读取推送的协程写入，不等待引擎
+	trades       chan *TradeDetailCh // 从 queue 按顺序取出交给引擎
+	errors       chan error
+	started      int32
+}
+
+func newWorkerBase(platform string, conn *wsConn, symbols []string, queue *tradeQueue) workerBase {
+	return workerBase{
+		platform: platform,
+		conn:     conn,
+		queue:    queue,
+		symbols:  append([]string(nil), symbols...),
+		trades:   make(chan *TradeDetailCh),
+		errors:   make(chan error, workerErrorBuffer),
+	}
+}
+
+// init 设置连接的回调，需要在 worker 创建好之后调用
+func (w *workerBase) init(onMessage func(message []byte)) {
+	w.conn.onConnect = w.subscribeAll
+	w.conn.onMessage = onMessage
+	w.conn.onError = func(op string, err error) {
+		w.reportError(&WorkerError{Platform: w.platform, Op: op, Err: err})
+	}
+	w.conn.onClose = w.queue.close
+}
+
+// Start 连接并订阅，连接失败返回错误，之后断线自动重连，ctx 取消后关闭连接
+func (w *workerBase) Start(ctx context.Context) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w.conn.isClosed() {
+		return ErrWorkerClosed
+	}
+	if !atomic.CompareAndSwapInt32(&w.started, 0, 1) {
+		return ErrWorkerStarted
+	}
+
+	if err := w.conn.dial(); err != nil {
+		return &WorkerError{Platform: w.platform, Op: OpDial, Err: err}
+	}
+	go w.pump()
+	go w.conn.run(ctx)
+	return nil
+}
+
+// pump 把队列中的成交交给引擎，连接关闭并且队列取完后关闭 trades
+func (w *workerBase) pump() {
+	defer func() {
+		close(w.trades)
+		w.queue.release()
+	}()
+
+	for {
+		trade, ok := w.queue.pop()
+		if !ok {
+			return
+		}
+		w.trades <- trade
+	}
+}
+
+// emit 收到成交，不会等待引擎处理
+func (w *workerBase) emit(trade *TradeDetailCh) {
+	w.queue.push(trade)
+}
+
+func (w *workerBase) Close() error {
+	return w.conn.Close()
+}
+
+// State 连接状态
+func (w *workerBase) State() ConnState {
+	return w.conn.State()
+}
+
+// Reconnection 累计重连次数
+func (w *workerBase) Reconnection() int {
+	return w.conn.Reconnection()
+}
+
+// OnReconnect 重连成功后的回调，需要在 Start 之前设置
+func (w *workerBase) OnReconnect(handler func()) {
+	w.conn.onReconnect = handler
+}
+
+// Trades 成交，连接关闭并且处理完之后关闭
+func (w *workerBase) Trades() <-chan *TradeDetailCh {
+	return w.trades
+}
+
+// QueueStats 推送到引擎之间的队列情况
+func (w *workerBase) QueueStats() QueueStats {
+	return w.queue.stats()
+}
+
+// Errors 运行中的错误，不会关闭，没有及时读取时丢弃
+func (w *workerBase) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *workerBase) WriteMessage(msg []byte) error {
+	if err := w.conn.WriteMessage(msg); err != nil {
+		return &WorkerError{Platform: w.platform, Op: OpWrite, Err: err}
+	}
+	return nil
+}
+
+// Subscribe 订阅交易对的成交，重连后自动重新订阅；还没有连接时只记录，连接成功后订阅
+func (w *workerBase) Subscribe(ctx context.Context, symbol string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w.conn.isClosed() {
+		return ErrWorkerClosed
+	}
+
+	w.mu.Lock()
+	exists := false
+	for _, item := range w.symbols {
+		if item == symbol {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		w.symbols = append(w.symbols, symbol)
+	}
+	w.mu.Unlock()
+
+	if w.State() != ConnConnected {
+		return nil
+	}
+	return w.subscribe(symbol)
+}
+
+func (w *workerBase) subscribe(symbol string) error {
+	msg, err := w.subscribeMsg(symbol)
+	if err == nil {
+		err = w.conn.WriteMessage(msg)
+	}
+	if err != nil {
+		return &WorkerError{Platform: w.platform, Op: OpSubscribe, Symbol: symbol, Err: err}
+	}
+	return nil
+}
+
+// subscribeAll 连接成功（包括重连）后订阅所有交易对
+func (w *workerBase) subscribeAll() {
+	w.mu.Lock()
+	symbols := append([]string(nil), w.symbols...)
+	w.mu.Unlock()
+
+	for _, symbol := range symbols {
+		if err := w.subscribe(symbol); err != nil {
+			w.reportError(err)
+		}
+	}
+}
+
+// reportError 不阻塞，错误通道满时丢弃
+func (w *workerBase) reportError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+// decodeError 解析推送失败
+func (w *workerBase) decodeError(err error) {
+	w.reportError(&WorkerError{Platform: w.platform, Op: OpDecode, Err: err})
+}
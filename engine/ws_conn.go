@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState 连接状态
+type ConnState int32
+
+const (
+	ConnConnecting ConnState = iota
+	ConnConnected
+	ConnReconnecting
+	ConnClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnReconnecting:
+		return "reconnecting"
+	case ConnClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+const (
+	wsMinBackoff  = time.Second      // 第一次重连等待
+	wsMaxBackoff  = time.Minute      // 最长重连等待
+	wsStableTime  = time.Minute      // 连接保持超过该时间，重连等待重新从最短开始
+	wsReadTimeout = 60 * time.Second // 超过该时间没有收到任何消息（包括 ping）认为连接已断开
+	wsWriteWait   = 10 * time.Second
+)
+
+// ErrNotConnected 连接断开还没有重连成功
+var ErrNotConnected = errors.New("websocket not connected")
+
+// wsConn 断线自动重连的 websocket 连接，重连成功后调用 onConnect 重新订阅
+type wsConn struct {
+	url          string
+	dialer       websocket.Dialer
+	onConnect    func()
+	onReconnect  func() // 重连并重新订阅之后调用
+	onMessage    func(message []byte)
+	onError      func(op string, err error) // 读取或者重连失败
+	onClose      func()                     // 关闭后读取协程退出前调用，之后不会再有 onMessage
+	pingMessage  []byte                     // 需要客户端主动发送的心跳消息
+	pingPeriod   time.Duration              // 心跳间隔
+	mu           sync.Mutex
+	conn         *websocket.Conn
+	state        int32
+	reconnection int32 // 累计重连次数
+	backoff      time.Duration
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newWsConn(wsUrl string, proxy func(r *http.Request) (*url.URL, error)) *wsConn {
+	return &wsConn{
+		url:    wsUrl,
+		dialer: websocket.Dialer{Proxy: proxy, HandshakeTimeout: 10 * time.Second},
+		state:  int32(ConnConnecting),
+		done:   make(chan struct{}),
+	}
+}
+
+// dial 建立连接
+func (c *wsConn) dial() error {
+	conn, _, err := c.dialer.Dial(c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	conn.SetPingHandler(func(appData string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsWriteWait))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		// 连接过程中被关闭了
+		conn.Close()
+		return ErrNotConnected
+	default:
+	}
+
+	c.setState(ConnConnected)
+	return nil
+}
+
+// run 读取消息，断开后按指数退避加随机抖动重连，直到 Close 或者 ctx 取消
+func (c *wsConn) run(ctx context.Context) {
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-c.done:
+		}
+	}()
+	defer func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	}()
+
+	if c.pingMessage != nil && c.pingPeriod > 0 {
+		go c.ping()
+	}
+
+	reconnected := false
+	for {
+		if c.onConnect != nil {
+			c.onConnect()
+		}
+		if reconnected && c.onReconnect != nil {
+			c.onReconnect()
+		}
+
+		connectedAt := time.Now()
+		c.read()
+
+		// 连接稳定过一段时间才重置等待时间，避免连上就断的情况频繁重连
+		if time.Since(connectedAt) > wsStableTime {
+			c.backoff = 0
+		}
+		if !c.reconnect() {
+			return
+		}
+		reconnected = true
+	}
+}
+
+func (c *wsConn) read() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if !c.isClosed() {
+				c.reportError(OpRead, err)
+			}
+			conn.Close()
+			return
+		}
+		c.onMessage(message)
+	}
+}
+
+// reconnect 重连成功返回 true，已关闭返回 false
+func (c *wsConn) reconnect() bool {
+
+	for {
+		if c.isClosed() {
+			return false
+		}
+		c.setState(ConnReconnecting)
+
+		if c.backoff < wsMinBackoff {
+			c.backoff = wsMinBackoff
+		}
+
+		// 等待 [backoff/2, backoff) 的随机时间，避免所有连接同时重连
+		wait := c.backoff/2 + time.Duration(rand.Int63n(int64(c.backoff/2)))
+		fmt.Printf("%s 连接断开，%v 后重连\n", c.url, wait)
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(wait):
+		}
+
+		c.backoff *= 2
+		if c.backoff > wsMaxBackoff {
+			c.backoff = wsMaxBackoff
+		}
+
+		atomic.AddInt32(&c.reconnection, 1)
+		err := c.dial()
+		if err == nil {
+			fmt.Println(c.url, "重连成功")
+			return true
+		}
+		c.reportError(OpDial, err)
+	}
+}
+
+func (c *wsConn) reportError(op string, err error) {
+	if c.onError != nil {
+		c.onError(op, err)
+	}
+}
+
+func (c *wsConn) ping() {
+	ticker := time.NewTicker(c.pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.State() == ConnConnected {
+				_ = c.WriteMessage(c.pingMessage)
+			}
+		}
+	}
+}
+
+// WriteMessage 发送文本消息，gorilla 的连接不支持并发写
+func (c *wsConn) WriteMessage(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// State 当前连接状态
+func (c *wsConn) State() ConnState {
+	return ConnState(atomic.LoadInt32(&c.state))
+}
+
+// Reconnection 累计重连次数
+func (c *wsConn) Reconnection() int {
+	return int(atomic.LoadInt32(&c.reconnection))
+}
+
+func (c *wsConn) setState(state ConnState) {
+	if c.isClosed() {
+		return
+	}
+	atomic.StoreInt32(&c.state, int32(state))
+}
+
+func (c *wsConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 关闭连接，不再重连
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		atomic.StoreInt32(&c.state, int32(ConnClosed))
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	return err
+}
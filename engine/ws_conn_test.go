@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wsTestServer 每个连接收到的第一条消息发到 subs，前 drops 个连接收到后立即断开
+func wsTestServer(t *testing.T, drops int32, subs chan<- string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var conns int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := atomic.AddInt32(&conns, 1)
+
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		subs <- string(message)
+		if n <= drops {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func wsTestUrl(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func waitState(t *testing.T, c *wsConn, state ConnState, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for c.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("State() = %s, want %s", c.State(), state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 服务端断开后重连并重新订阅
+func TestWsConnReconnect(t *testing.T) {
+	subs := make(chan string, 10)
+	server, conns := wsTestServer(t, 1, subs)
+
+	c := newWsConn(wsTestUrl(server), nil)
+	c.onConnect = func() {
+		if err := c.WriteMessage([]byte("sub")); err != nil {
+			t.Errorf("WriteMessage() error = %v", err)
+		}
+	}
+	reconnected := make(chan struct{}, 1)
+	c.onReconnect = func() {
+		reconnected <- struct{}{}
+	}
+	c.onMessage = func(message []byte) {}
+	var readErrors int32
+	c.onError = func(op string, err error) {
+		if op == OpRead {
+			atomic.AddInt32(&readErrors, 1)
+		}
+	}
+	closed := make(chan struct{})
+	c.onClose = func() {
+		close(closed)
+	}
+
+	if c.State() != ConnConnecting {
+		t.Fatalf("State() = %s, want %s", c.State(), ConnConnecting)
+	}
+	if err := c.dial(); err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != ConnConnected {
+		t.Fatalf("State() = %s, want %s", c.State(), ConnConnected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+
+	if msg := <-subs; msg != "sub" {
+		t.Fatalf("first subscribe = %q", msg)
+	}
+
+	// 断开后等待重连，重连等待至少 wsMinBackoff/2
+	waitState(t, c, ConnReconnecting, time.Second)
+	if c.Reconnection() != 0 {
+		t.Fatalf("Reconnection() = %d before reconnect", c.Reconnection())
+	}
+
+	select {
+	case msg := <-subs:
+		if msg != "sub" {
+			t.Fatalf("resubscribe = %q", msg)
+		}
+	case <-time.After(3 * wsMinBackoff):
+		t.Fatal("subscribe not sent after reconnect")
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("onReconnect not called")
+	}
+
+	if c.State() != ConnConnected {
+		t.Fatalf("State() = %s, want %s", c.State(), ConnConnected)
+	}
+	if got := c.Reconnection(); got != 1 {
+		t.Fatalf("Reconnection() = %d, want 1", got)
+	}
+	if got := atomic.LoadInt32(conns); got != 2 {
+		t.Fatalf("connections = %d, want 2", got)
+	}
+	if got := atomic.LoadInt32(&readErrors); got != 1 {
+		t.Fatalf("read errors = %d, want 1", got)
+	}
+
+	// ctx 取消后关闭，不再重连
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("onClose not called")
+	}
+	if c.State() != ConnClosed {
+		t.Fatalf("State() = %s, want %s", c.State(), ConnClosed)
+	}
+	if err := c.WriteMessage([]byte("sub")); err == nil {
+		t.Fatal("WriteMessage() after close succeeded")
+	}
+}
+
+// 重连失败时报告 dial 错误并继续重试，Close 后停止
+func TestWsConnReconnectDialError(t *testing.T) {
+	subs := make(chan string, 10)
+	server, _ := wsTestServer(t, 1, subs)
+
+	c := newWsConn(wsTestUrl(server), nil)
+	c.onConnect = func() {
+		_ = c.WriteMessage([]byte("sub"))
+	}
+	c.onMessage = func(message []byte) {}
+	dialErrors := make(chan error, 10)
+	c.onError = func(op string, err error) {
+		if op == OpDial {
+			dialErrors <- err
+		}
+	}
+	if err := c.dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	go c.run(context.Background())
+	<-subs
+	// 服务端停止后重连失败
+	server.Close()
+
+	select {
+	case <-dialErrors:
+	case <-time.After(3 * wsMinBackoff):
+		t.Fatal("dial error not reported")
+	}
+	if c.State() != ConnReconnecting {
+		t.Fatalf("State() = %s, want %s", c.State(), ConnReconnecting)
+	}
+	if c.Reconnection() < 1 {
+		t.Fatalf("Reconnection() = %d, want >= 1", c.Reconnection())
+	}
+
+	_ = c.Close()
+	waitState(t, c, ConnClosed, time.Second)
+}
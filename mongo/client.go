@@ -23,13 +23,16 @@ func NewClient(uri string) (*mongo.Client, error) {
 	return mgoCli, nil
 }
 
-func NewTrade(uri string) (*mongo.Database, error) {
+func NewTrade(uri string, database string) (*mongo.Database, error) {
 	client, err := NewClient(uri)
 	if err != nil {
 		return nil, err
 	}
 
-	db := client.Database("trade")
+	if database == "" {
+		database = "trade"
+	}
+	db := client.Database(database)
 
 	return db, nil
 }
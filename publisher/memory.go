@@ -0,0 +1,122 @@
+package publisher
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Message 总线上的一条消息
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// MemoryBroker 进程内的消息总线，用于测试和单进程部署
+// 每个订阅单独缓冲，缓冲满的订阅丢弃这条消息，慢的订阅不影响其它订阅和发送方
+type MemoryBroker struct {
+	mu      sync.RWMutex
+	subs    map[*memorySub]bool
+	closed  bool
+	dropped uint64
+}
+
+type memorySub struct {
+	pattern []string
+	ch      chan Message
+}
+
+// NewMemoryBroker 创建
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subs: make(map[*memorySub]bool),
+	}
+}
+
+// Subscribe 订阅主题，按 . 分段，* 匹配一段，> 匹配剩下的所有段，如 kline.*.1min、kline.>
+func (b *MemoryBroker) Subscribe(pattern string, buffer int) (<-chan Message, func()) {
+	sub := &memorySub{
+		pattern: strings.Split(pattern, "."),
+		ch:      make(chan Message, buffer),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	b.subs[sub] = true
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.subs[sub] {
+				delete(b.subs, sub)
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+// Publish 投递到所有匹配的订阅，不阻塞，缓冲满的订阅丢弃这条消息，只有关闭后返回错误
+func (b *MemoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	segments := strings.Split(topic, ".")
+	for sub := range b.subs {
+		if !matchTopic(sub.pattern, segments) {
+			continue
+		}
+		select {
+		case sub.ch <- Message{Topic: topic, Payload: payload}:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Dropped 订阅缓冲满时丢弃的消息数量，每个订阅分别计数
+func (b *MemoryBroker) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close 关闭所有订阅
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+	return nil
+}
+
+func matchTopic(pattern []string, segments []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(segments) > i
+		}
+		if i >= len(segments) || (p != "*" && p != segments[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
@@ -0,0 +1,77 @@
+package publisher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"kline.btcusdt.1min", "kline.btcusdt.1min", true},
+		{"kline.btcusdt.1min", "kline.btcusdt.5min", false},
+		{"kline.*.1min", "kline.ethusdt.1min", true},
+		{"kline.*.1min", "kline.ethusdt.1min.x", false},
+		{"kline.>", "kline.btcusdt.1min", true},
+		{"kline.>", "kline", false},
+		{"trade.>", "kline.btcusdt.1min", false},
+		{"kline.*", "kline.btcusdt.1min", false},
+	}
+	for _, tt := range tests {
+		got := matchTopic(strings.Split(tt.pattern, "."), strings.Split(tt.topic, "."))
+		if got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// 不读取的订阅缓冲满后只丢弃自己的消息，其它订阅照常收到，发送方不会收到错误
+func TestMemoryBrokerSlowSubscriber(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	slow, cancelSlow := b.Subscribe("kline.>", 1)
+	defer cancelSlow()
+	fast, cancelFast := b.Subscribe("kline.*.1min", 10)
+	defer cancelFast()
+
+	for i := 0; i < 5; i++ {
+		if err := b.Publish("kline.btcusdt.1min", []byte{byte(i)}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		msg := <-fast
+		if msg.Payload[0] != byte(i) {
+			t.Fatalf("fast got %d, want %d", msg.Payload[0], i)
+		}
+	}
+	if msg := <-slow; msg.Payload[0] != 0 {
+		t.Fatalf("slow got %d, want 0", msg.Payload[0])
+	}
+	if got := b.Dropped(); got != 4 {
+		t.Fatalf("Dropped() = %d, want 4", got)
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	ch, cancel := b.Subscribe("kline.>", 1)
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("subscription not closed")
+	}
+	// 关闭后取消订阅不会重复关闭
+	cancel()
+
+	if err := b.Publish("kline.btcusdt.1min", nil); err != ErrBrokerClosed {
+		t.Fatalf("Publish() error = %v, want %v", err, ErrBrokerClosed)
+	}
+}
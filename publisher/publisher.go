@@ -0,0 +1,234 @@
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shopspring/decimal"
+	"sync"
+	"sync-kline/config"
+	"sync-kline/engine"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minRetryWait = 100 * time.Millisecond
+	maxRetryWait = 5 * time.Second
+)
+
+// KLineMessage K线消息，主题为 kline.<symbol>.<period>
+type KLineMessage struct {
+	Source string        `json:"source"` // 数据源
+	Symbol string        `json:"symbol"` // 交易对
+	Period string        `json:"period"` // 周期
+	Closed bool          `json:"closed"` // 是否已收盘
+	Ts     int64         `json:"ts"`     // 发送时间（毫秒）
+	KLine  *engine.KLine `json:"kline"`
+}
+
+// TradeMessage 成交消息，主题为 trade.<symbol>
+type TradeMessage struct {
+	Source  string          `json:"source"`   // 数据源
+	Symbol  string          `json:"symbol"`   // 交易对
+	Time    int64           `json:"time"`     // 成交时间（秒）
+	Price   decimal.Decimal `json:"price"`    // 价格
+	Amount  decimal.Decimal `json:"amount"`   // 数量
+	TradeId int64           `json:"trade_id"` // 成交 ID
+	Side    string          `json:"side"`     // 主动成交方向 buy/sell
+}
+
+// Stats 发送统计
+type Stats struct {
+	Published uint64 `json:"published"` // 发送成功
+	Retries   uint64 `json:"retries"`   // 发送失败重试次数
+	Dropped   uint64 `json:"dropped"`   // 缓冲满或者重试后仍然失败丢弃
+	Pending   int    `json:"pending"`   // 缓冲中等待发送
+}
+
+// Publisher 把成交和K线发送到消息总线，实现 engine.Sink
+// 消息先进入有界缓冲，由单独的协程按顺序发送，失败后一直重试（默认 retries 为 -1），至少发送一次；
+// 缓冲满时丢弃新消息，配置了 retries 时重试后仍然失败也丢弃
+type Publisher struct {
+	transport Transport
+	prefix    string
+	trades    bool
+	retries   int
+	buffer    chan Message
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	inflight  *Message // 关闭时正在重试的消息
+	published uint64
+	retried   uint64
+	dropped   uint64
+}
+
+// NewPublisher 创建并开始发送
+func NewPublisher(transport Transport, conf *config.PublisherConfig) *Publisher {
+	size := conf.Buffer
+	if size <= 0 {
+		size = 10000
+	}
+	p := &Publisher{
+		transport: transport,
+		prefix:    conf.TopicPrefix,
+		trades:    conf.Trades,
+		retries:   conf.Retries,
+		buffer:    make(chan Message, size),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// OnTrade 发送逐笔成交
+func (p *Publisher) OnTrade(name string, trade *engine.TradeDetailCh) {
+	if !p.trades {
+		return
+	}
+	symbol := engine.NormalizeSymbol(trade.Symbol)
+	p.enqueue(p.prefix+"trade."+symbol, TradeMessage{
+		Source:  name,
+		Symbol:  symbol,
+		Time:    trade.Time,
+		Price:   trade.Price,
+		Amount:  trade.Amount,
+		TradeId: trade.TradeId,
+		Side:    trade.Side,
+	})
+}
+
+// OnCandleUpdate 发送未收盘的K线
+func (p *Publisher) OnCandleUpdate(name string, symbol string, period string, kLine *engine.KLine) {
+	p.enqueueKLine(name, symbol, period, kLine, false)
+}
+
+// OnCandleClose 发送收盘的K线
+func (p *Publisher) OnCandleClose(name string, symbol string, period string, kLine *engine.KLine) {
+	p.enqueueKLine(name, symbol, period, kLine, true)
+}
+
+func (p *Publisher) enqueueKLine(name string, symbol string, period string, kLine *engine.KLine, closed bool) {
+	p.enqueue(p.prefix+fmt.Sprintf("kline.%s.%s", symbol, period), KLineMessage{
+		Source: name,
+		Symbol: symbol,
+		Period: period,
+		Closed: closed,
+		Ts:     time.Now().UnixMilli(),
+		KLine:  kLine,
+	})
+}
+
+// enqueue 不阻塞，缓冲满或者已关闭时丢弃
+func (p *Publisher) enqueue(topic string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-p.done:
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	default:
+	}
+
+	select {
+	case p.buffer <- Message{Topic: topic, Payload: payload}:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.stopped)
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case msg := <-p.buffer:
+			if !p.send(msg) {
+				p.inflight = &msg
+				return
+			}
+		}
+	}
+}
+
+// send 失败后按指数退避重试，超过重试次数时丢弃，关闭时返回 false
+func (p *Publisher) send(msg Message) bool {
+	wait := minRetryWait
+	for attempt := 0; ; attempt++ {
+		err := p.transport.Publish(msg.Topic, msg.Payload)
+		if err == nil {
+			atomic.AddUint64(&p.published, 1)
+			return true
+		}
+		if err == ErrBrokerClosed || (p.retries >= 0 && attempt >= p.retries) {
+			fmt.Println("发送消息失败，丢弃", msg.Topic, err)
+			atomic.AddUint64(&p.dropped, 1)
+			return true
+		}
+		atomic.AddUint64(&p.retried, 1)
+		fmt.Println("发送消息失败", msg.Topic, err)
+
+		select {
+		case <-p.done:
+			return false
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+}
+
+// Stats 发送统计
+func (p *Publisher) Stats() Stats {
+	return Stats{
+		Published: atomic.LoadUint64(&p.published),
+		Retries:   atomic.LoadUint64(&p.retried),
+		Dropped:   atomic.LoadUint64(&p.dropped),
+		Pending:   len(p.buffer),
+	}
+}
+
+// Close 停止接收新消息，在 timeout 内尽量把缓冲中的消息发送完，然后关闭消息总线
+func (p *Publisher) Close(timeout time.Duration) error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		<-p.stopped
+
+		deadline := time.Now().Add(timeout)
+		if p.inflight != nil {
+			if p.transport.Publish(p.inflight.Topic, p.inflight.Payload) == nil {
+				atomic.AddUint64(&p.published, 1)
+			} else {
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		}
+	drain:
+		for time.Now().Before(deadline) {
+			select {
+			case msg := <-p.buffer:
+				if p.transport.Publish(msg.Topic, msg.Payload) == nil {
+					atomic.AddUint64(&p.published, 1)
+				} else {
+					atomic.AddUint64(&p.dropped, 1)
+				}
+			default:
+				break drain
+			}
+		}
+		if n := len(p.buffer); n > 0 {
+			fmt.Println("关闭时还有", n, "条消息没有发送")
+		}
+
+		err = p.transport.Close()
+	})
+	return err
+}
@@ -0,0 +1,131 @@
+package publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"sync-kline/config"
+	"sync-kline/engine"
+	"testing"
+	"time"
+)
+
+func TestPublisherKLine(t *testing.T) {
+	b := NewMemoryBroker()
+	ch, cancel := b.Subscribe("prod.kline.>", 10)
+	defer cancel()
+
+	p := NewPublisher(b, &config.PublisherConfig{TopicPrefix: "prod.", Buffer: 10, Retries: -1})
+
+	price, _ := primitive.ParseDecimal128("100.5")
+	p.OnCandleUpdate("huobi", "btcusdt", "1min", &engine.KLine{Time: 60, Close: price})
+	p.OnCandleClose("huobi", "btcusdt", "1min", &engine.KLine{Time: 60, Close: price})
+	// 没有开启成交
+	p.OnTrade("huobi", &engine.TradeDetailCh{Symbol: "btcusdt"})
+
+	for _, closed := range []bool{false, true} {
+		select {
+		case msg := <-ch:
+			if msg.Topic != "prod.kline.btcusdt.1min" {
+				t.Fatalf("topic = %s", msg.Topic)
+			}
+			var m KLineMessage
+			if err := json.Unmarshal(msg.Payload, &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Source != "huobi" || m.Symbol != "btcusdt" || m.Period != "1min" || m.Closed != closed || m.KLine.Time != 60 {
+				t.Fatalf("message = %+v", m)
+			}
+			if m.KLine.Close.String() != "100.5" {
+				t.Fatalf("close = %s", m.KLine.Close)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err := p.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Published != 2 || stats.Dropped != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+// 订阅不读取时发送方不会卡住，后面的消息照常发送
+func TestPublisherSlowSubscriber(t *testing.T) {
+	b := NewMemoryBroker()
+	_, cancelSlow := b.Subscribe("kline.>", 1)
+	defer cancelSlow()
+	fast, cancelFast := b.Subscribe("kline.>", 100)
+	defer cancelFast()
+
+	p := NewPublisher(b, &config.PublisherConfig{Buffer: 100, Retries: -1})
+	for i := 0; i < 50; i++ {
+		p.OnCandleUpdate("huobi", "btcusdt", "1min", &engine.KLine{Time: int64(i)})
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case <-fast:
+		case <-time.After(time.Second):
+			t.Fatalf("received %d messages, want 50", i)
+		}
+	}
+
+	_ = p.Close(time.Second)
+	if stats := p.Stats(); stats.Published != 50 || stats.Retries != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if got := b.Dropped(); got != 49 {
+		t.Fatalf("Dropped() = %d, want 49", got)
+	}
+}
+
+// failTransport 前 fails 次发送失败
+type failTransport struct {
+	mu    sync.Mutex
+	fails int
+	calls int
+	sent  []string
+}
+
+func (f *failTransport) Publish(topic string, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.fails {
+		return errors.New("unavailable")
+	}
+	f.sent = append(f.sent, topic)
+	return nil
+}
+
+func (f *failTransport) Close() error {
+	return nil
+}
+
+// 重试次数用完后丢弃，后面的消息不受影响
+func TestPublisherRetryLimit(t *testing.T) {
+	transport := &failTransport{fails: 2}
+	p := NewPublisher(transport, &config.PublisherConfig{Buffer: 10, Retries: 1})
+
+	p.OnCandleUpdate("huobi", "btcusdt", "1min", &engine.KLine{Time: 0})
+	p.OnCandleUpdate("huobi", "ethusdt", "1min", &engine.KLine{Time: 0})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Published == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = p.Close(time.Second)
+
+	stats := p.Stats()
+	if stats.Published != 1 || stats.Dropped != 1 || stats.Retries != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(transport.sent) != 1 || transport.sent[0] != "kline.ethusdt.1min" {
+		t.Fatalf("sent = %v", transport.sent)
+	}
+}
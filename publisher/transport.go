@@ -0,0 +1,25 @@
+package publisher
+
+import (
+	"fmt"
+	"sync-kline/config"
+)
+
+// Transport 消息总线，Publish 返回错误时会重试，需要能接受重复的消息
+type Transport interface {
+	Publish(topic string, payload []byte) error
+	Close() error
+}
+
+const (
+	TransportMemory = "memory" // 进程内的消息总线
+)
+
+// NewTransport 按配置创建消息总线
+func NewTransport(conf *config.PublisherConfig) (Transport, error) {
+	switch conf.Transport {
+	case "", TransportMemory:
+		return NewMemoryBroker(), nil
+	}
+	return nil, fmt.Errorf("不支持的消息总线: %s", conf.Transport)
+}
@@ -17,6 +17,10 @@ var (
 	ErrLoginNot         = &Errno{Code: 10009, Message: "用户名/密码/谷歌验证码错误"}
 	ErrOldGoogleAuth    = &Errno{Code: 10010, Message: "旧谷歌验证码错误"}
 	ErrGoogleAuth       = &Errno{Code: 10011, Message: "谷歌验证码错误"}
+	ErrSymbol           = &Errno{Code: 10012, Message: "交易对不存在"}
+	ErrPeriod           = &Errno{Code: 10013, Message: "不支持的K线周期"}
+	ErrTimeRange        = &Errno{Code: 10014, Message: "时间范围有误"}
+	ErrSource           = &Errno{Code: 10015, Message: "数据源不存在"}
 )
 
 // Errno ...
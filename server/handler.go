@@ -2,18 +2,68 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"sync-kline/engine"
+	"sync-kline/publisher"
 )
 
+// KLine 查询K线
 func KLine(c *gin.Context) {
 
-	var q CreateWalletReq
+	var q KLineReq
 
-	if err := c.ShouldBindJSON(&q); err != nil {
+	if err := c.ShouldBindQuery(&q); err != nil {
 		HandleValidatorError(c, err)
 		return
 	}
 
-	res := CreateWalletRes{}
+	eng := c.MustGet("engine").(*engine.ConCurrentEngine)
+
+	if q.Source == "" {
+		q.Source = eng.Sources()[0]
+	}
+	if !eng.HasSource(q.Source) {
+		APIResponse(c, ErrSource, nil)
+		return
+	}
+
+	if !eng.HasSymbol(q.Source, q.Symbol) {
+		APIResponse(c, ErrSymbol, nil)
+		return
+	}
+
+	period, ok := engine.KlinePeriodName(q.Period)
+	if !ok || !eng.HasPeriod(q.Source, period) {
+		APIResponse(c, ErrPeriod, nil)
+		return
+	}
+
+	if q.From > 0 && q.To > 0 && q.From > q.To {
+		APIResponse(c, ErrTimeRange, nil)
+		return
+	}
+
+	kLines, err := eng.KlineHistory(q.Source, q.Symbol, period, q.From, q.To, q.Limit)
+	if err != nil {
+		APIResponse(c, InternalServerError, nil)
+		return
+	}
+
+	APIResponse(c, nil, kLines)
+}
+
+// Status 数据源连接状态、聚合分片的处理情况和消息总线的发送统计
+func Status(c *gin.Context) {
+
+	eng := c.MustGet("engine").(*engine.ConCurrentEngine)
+
+	res := StatusRes{
+		Sources: eng.Status(),
+		Shards:  eng.ShardStats(),
+	}
+	if pub, ok := c.Get("publisher"); ok {
+		stats := pub.(*publisher.Publisher).Stats()
+		res.Publisher = &stats
+	}
 
 	APIResponse(c, nil, res)
 }
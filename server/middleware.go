@@ -4,6 +4,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/mongo"
 	"net/http"
+	"sync-kline/engine"
+	"sync-kline/publisher"
 )
 
 // SetDB DB
@@ -15,6 +17,24 @@ func SetDB(db *mongo.Database) gin.HandlerFunc {
 
 }
 
+// SetEngine 引擎
+func SetEngine(eng *engine.ConCurrentEngine) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		c.Set("engine", eng)
+	}
+
+}
+
+// SetPublisher 消息总线
+func SetPublisher(pub *publisher.Publisher) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		c.Set("publisher", pub)
+	}
+
+}
+
 // Cors 跨域设置
 func Cors() gin.HandlerFunc {
 	return func(c *gin.Context) {
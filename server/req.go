@@ -5,11 +5,11 @@ type ListPageReq struct {
 	Limit int `form:"limit" binding:"required,gte=1,lte=200"` // 每页返回多少
 }
 
-type CreateWalletReq struct {
-	Appid       string `json:"appid" binding:"required"`        // 应用ID
-	Sign        string `json:"sign" binding:"required"`         // 签名
-	NetworkName string `json:"network_name" binding:"required"` // 网络名称
-	CoinSymbol  string `json:"coin_symbol" binding:"required"`  // 币种符号
-	MemberId    string `json:"member_id" binding:"required"`    // 用户ID
-	CallUrl     string `json:"call_url" binding:"required"`     // 回调url
+type KLineReq struct {
+	Source string `form:"source"`                                   // 数据源，默认第一个
+	Symbol string `form:"symbol" binding:"required"`                // 交易对
+	Period string `form:"period" binding:"required"`                // 周期
+	From   int64  `form:"from" binding:"gte=0"`                     // 开始时间（秒）
+	To     int64  `form:"to" binding:"gte=0"`                       // 结束时间（秒）
+	Limit  int    `form:"limit" binding:"omitempty,gte=1,lte=2000"` // 返回条数，默认200
 }
@@ -3,6 +3,8 @@ package server
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"sync-kline/engine"
+	"sync-kline/publisher"
 )
 
 // Response ...
@@ -12,6 +14,13 @@ type Response struct {
 	Data    interface{} `json:"data"`    // 成功时返回的对象
 }
 
+// StatusRes 运行状态
+type StatusRes struct {
+	Sources   []engine.SourceStatus `json:"sources"`             // 数据源连接状态
+	Shards    []engine.ShardStats   `json:"shards"`              // 聚合分片的处理情况
+	Publisher *publisher.Stats      `json:"publisher,omitempty"` // 消息总线的发送统计，没有开启时为空
+}
+
 // APIResponse ....
 func APIResponse(Ctx *gin.Context, err error, data interface{}) {
 	if err == nil {
@@ -24,8 +33,3 @@ func APIResponse(Ctx *gin.Context, err error, data interface{}) {
 		Data:    data,
 	})
 }
-
-// CreateWalletRes ...
-type CreateWalletRes struct {
-	Address string `json:"address"` // 生成的钱包地址
-}
@@ -1,15 +1,21 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"os/signal"
 	"sync-kline/config"
 	"sync-kline/engine"
 	"sync-kline/mongo"
+	"sync-kline/publisher"
+	"syscall"
+	"time"
 )
 
-// Start 启动服务
-func Start(isSwag bool, configPath string) {
+// Start 启动服务，收到退出信号后返回；连接交易所失败等引擎出错时返回错误
+func Start(isSwag bool, configPath string) error {
 
 	conf, err := config.NewConfig(configPath)
 
@@ -17,16 +23,45 @@ func Start(isSwag bool, configPath string) {
 		panic("Failed to load configuration")
 	}
 
-	db, err := mongo.NewTrade(conf.Mongo.Uri)
+	db, err := mongo.NewTrade(conf.Mongo.Uri, conf.Mongo.Database)
 	if err != nil {
 		panic(err)
 	}
 
-	eng, err := engine.NewEngine(db, &conf.Engine)
+	// 收到退出信号后停止采集，写入K线，关闭 HTTP 服务和数据库连接
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	eng, err := engine.NewEngine(ctx, db, &conf.Mongo, &conf.Engine)
 	if err != nil {
 		panic(fmt.Sprintf("eth run err：%v", err))
 	}
-	go eng.Start()
+
+	// K线推送
+	hub := NewHub(eng)
+	eng.AddSink(hub)
+
+	// 发送到消息总线
+	var pub *publisher.Publisher
+	if conf.Publisher.Enable {
+		transport, err := publisher.NewTransport(&conf.Publisher)
+		if err != nil {
+			panic(err)
+		}
+		pub = publisher.NewPublisher(transport, &conf.Publisher)
+		eng.AddSink(pub)
+	}
+
+	engineDone := make(chan struct{})
+	var engineErr error
+	go func() {
+		defer close(engineDone)
+		if err := eng.Start(ctx); err != nil {
+			engineErr = err
+			// 连接交易所失败时退出
+			stop()
+		}
+	}()
 
 	if isSwag {
 		gin.SetMode(gin.DebugMode)
@@ -40,14 +75,61 @@ func Start(isSwag bool, configPath string) {
 	server.Use(gin.Recovery())
 	server.Use(Cors())
 	server.Use(SetDB(db))
+	server.Use(SetEngine(eng))
+	if pub != nil {
+		server.Use(SetPublisher(pub))
+	}
+
+	server.GET("/kline", KLine)
+	server.GET("/ws", hub.ServeWs)
+	server.GET("/status", Status)
 
-	server.POST("/kline", KLine)
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%v", conf.App.Port),
+		Handler: server,
+	}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic("start error")
+		}
+	}()
 
 	fmt.Println("start success")
 
-	err = server.Run(fmt.Sprintf(":%v", conf.App.Port))
-	if err != nil {
-		panic("start error")
+	<-ctx.Done()
+	// 再次收到信号时直接退出
+	stop()
+	fmt.Println("正在退出")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.App.ShutdownTimeout)*time.Millisecond)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		fmt.Println("关闭 HTTP 服务失败", err)
 	}
+	// websocket 连接已经脱离 HTTP 服务，需要单独关闭
+	hub.Close()
 
+	// 等待处理完已经收到的成交，内存中的K线写入
+	select {
+	case <-engineDone:
+	case <-shutdownCtx.Done():
+		fmt.Println("等待K线写入超时")
+	}
+
+	// 收盘消息发送完
+	if pub != nil {
+		_ = pub.Close(time.Duration(conf.Publisher.CloseWait) * time.Millisecond)
+	}
+
+	if err := db.Client().Disconnect(shutdownCtx); err != nil {
+		fmt.Println("关闭数据库连接失败", err)
+	}
+
+	select {
+	case <-engineDone:
+		return engineErr
+	default:
+		return nil
+	}
 }
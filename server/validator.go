@@ -14,7 +14,9 @@ func HandleValidatorError(c *gin.Context, err error) {
 	//如何返回错误信息
 	errs, ok := err.(validator.ValidationErrors)
 	if !ok {
-		APIResponse(c, InternalServerError, nil)
+		// 非校验类错误（如类型转换失败）统一按参数错误返回
+		APIResponse(c, ErrParam, nil)
+		return
 	}
 	APIResponse(c, ErrParam, firstErr(errs.Translate(trans)))
 	return
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync-kline/engine"
+	"time"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second    // 单次写超时
+	wsPongWait   = 60 * time.Second    // 超过该时间没有收到任何消息则断开
+	wsPingPeriod = wsPongWait * 9 / 10 // 服务端心跳间隔
+	wsReadLimit  = 1024                // 客户端消息最大长度
+	wsSendBuffer = 256                 // 每个连接的发送缓冲
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// WsReq 客户端消息
+type WsReq struct {
+	Id     string `json:"id"`
+	Source string `json:"source"` // 数据源，默认第一个
+	Sub    string `json:"sub"`
+	Unsub  string `json:"unsub"`
+	Ping   int64  `json:"ping"`
+}
+
+// WsRes 订阅/取消订阅的回复
+type WsRes struct {
+	Id       string `json:"id,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Status   string `json:"status"`
+	Subbed   string `json:"subbed,omitempty"`
+	Unsubbed string `json:"unsubbed,omitempty"`
+	ErrMsg   string `json:"err-msg,omitempty"`
+	Ts       int64  `json:"ts"`
+}
+
+// WsPush K线推送
+type WsPush struct {
+	Source string        `json:"source"`
+	Ch     string        `json:"ch"`
+	Ts     int64         `json:"ts"`
+	Tick   *engine.KLine `json:"tick"`
+}
+
+// Hub 管理所有的 websocket 连接和订阅关系
+type Hub struct {
+	eng     *engine.ConCurrentEngine
+	mu      sync.RWMutex
+	topics  map[wsKey]map[*wsClient]string // 订阅的连接和连接订阅时使用的主题
+	clients map[*wsClient]bool
+	closed  bool
+}
+
+// wsKey 订阅的数据源和标准化后的主题，只用于查找订阅，推送和回复使用客户端订阅时的主题
+type wsKey struct {
+	source string
+	topic  string
+}
+
+type wsClient struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte
+	done   chan struct{}
+	once   sync.Once
+	topics map[wsKey]string // 订阅时的主题，由 hub.mu 保护
+}
+
+// NewHub 创建
+func NewHub(eng *engine.ConCurrentEngine) *Hub {
+	return &Hub{
+		eng:     eng,
+		topics:  make(map[wsKey]map[*wsClient]string),
+		clients: make(map[*wsClient]bool),
+	}
+}
+
+// Close 退出时通知并关闭所有连接，之后的连接直接关闭
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	clients := make([]*wsClient, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		client.shutdown()
+	}
+}
+
+// Publish 推送K线到订阅了该交易对周期的连接，发送缓冲满的连接直接断开，不会阻塞采集
+func (h *Hub) Publish(name string, symbol string, period string, kLine *engine.KLine) {
+
+	key := wsKey{source: name, topic: wsTopic(symbol, period)}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := h.topics[key]
+	if len(clients) == 0 {
+		return
+	}
+
+	// 同一个K线可能用不同的别名订阅，如 60min、1hour，按客户端的主题分别推送
+	ts := time.Now().UnixMilli()
+	msgs := make(map[string][]byte)
+	for client, topic := range clients {
+		msg, ok := msgs[topic]
+		if !ok {
+			var err error
+			msg, err = json.Marshal(WsPush{
+				Source: name,
+				Ch:     topic,
+				Ts:     ts,
+				Tick:   kLine,
+			})
+			if err != nil {
+				return
+			}
+			msgs[topic] = msg
+		}
+		if !client.push(msg) {
+			go client.close()
+		}
+	}
+}
+
+// OnTrade 不推送逐笔成交
+func (h *Hub) OnTrade(name string, trade *engine.TradeDetailCh) {}
+
+// OnCandleUpdate K线变动时推送
+func (h *Hub) OnCandleUpdate(name string, symbol string, period string, kLine *engine.KLine) {
+	h.Publish(name, symbol, period, kLine)
+}
+
+// OnCandleClose 收盘前最后一次变动已经推送过
+func (h *Hub) OnCandleClose(name string, symbol string, period string, kLine *engine.KLine) {}
+
+// ServeWs 处理 websocket 连接
+func (h *Hub) ServeWs(c *gin.Context) {
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+
+	client := &wsClient{
+		hub:    h,
+		conn:   conn,
+		send:   make(chan []byte, wsSendBuffer),
+		done:   make(chan struct{}),
+		topics: make(map[wsKey]string),
+	}
+	if !h.register(client) {
+		client.shutdown()
+		return
+	}
+
+	go client.writePump()
+	client.readPump()
+}
+
+// parseTopic 解析 market.btcusdt.kline.1min，返回标准化后的主题，如 market.BTC-USDT.kline.60min 为 market.btcusdt.kline.1hour
+func (h *Hub) parseTopic(source string, topic string) (wsKey, error) {
+	if source == "" {
+		source = h.eng.Sources()[0]
+	}
+	if !h.eng.HasSource(source) {
+		return wsKey{}, fmt.Errorf("invalid source %s", source)
+	}
+	parts := strings.Split(topic, ".")
+	if len(parts) != 4 || parts[0] != "market" || parts[2] != "kline" {
+		return wsKey{}, fmt.Errorf("invalid topic %s", topic)
+	}
+	if !h.eng.HasSymbol(source, parts[1]) {
+		return wsKey{}, fmt.Errorf("invalid symbol %s", parts[1])
+	}
+	period, ok := engine.KlinePeriodName(parts[3])
+	if !ok || !h.eng.HasPeriod(source, period) {
+		return wsKey{}, fmt.Errorf("invalid period %s", parts[3])
+	}
+	return wsKey{source: source, topic: wsTopic(parts[1], period)}, nil
+}
+
+// subscribe 订阅，topic 为客户端的主题，同一个K线用别名再次订阅时之后按新的主题推送
+func (h *Hub) subscribe(client *wsClient, key wsKey, topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients, ok := h.topics[key]
+	if !ok {
+		clients = make(map[*wsClient]string)
+		h.topics[key] = clients
+	}
+	clients[client] = topic
+	client.topics[key] = topic
+}
+
+func (h *Hub) unsubscribe(client *wsClient, key wsKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(client, key)
+}
+
+// register 记录连接，已经关闭时返回 false
+func (h *Hub) register(client *wsClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return false
+	}
+	h.clients[client] = true
+	return true
+}
+
+func (h *Hub) unregister(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range client.topics {
+		h.removeLocked(client, key)
+	}
+	delete(h.clients, client)
+}
+
+func (h *Hub) removeLocked(client *wsClient, key wsKey) {
+	delete(client.topics, key)
+	if clients, ok := h.topics[key]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.topics, key)
+		}
+	}
+}
+
+// push 非阻塞写入发送缓冲
+func (cl *wsClient) push(msg []byte) bool {
+	select {
+	case <-cl.done:
+		return true
+	case cl.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cl *wsClient) reply(v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if !cl.push(msg) {
+		go cl.close()
+	}
+}
+
+func (cl *wsClient) close() {
+	cl.once.Do(func() {
+		close(cl.done)
+		cl.conn.Close()
+	})
+}
+
+// shutdown 发送关闭帧后关闭连接
+func (cl *wsClient) shutdown() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+	_ = cl.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	cl.close()
+}
+
+func (cl *wsClient) readPump() {
+	defer func() {
+		cl.hub.unregister(cl)
+		cl.close()
+	}()
+
+	cl.conn.SetReadLimit(wsReadLimit)
+	_ = cl.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	cl.conn.SetPongHandler(func(string) error {
+		return cl.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, message, err := cl.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = cl.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var req WsReq
+		if err := json.Unmarshal(message, &req); err != nil {
+			cl.reply(WsRes{Status: "error", ErrMsg: "invalid message", Ts: time.Now().UnixMilli()})
+			continue
+		}
+
+		switch {
+		case req.Ping > 0:
+			cl.reply(map[string]int64{"pong": req.Ping})
+		case req.Sub != "":
+			key, err := cl.hub.parseTopic(req.Source, req.Sub)
+			if err != nil {
+				cl.reply(WsRes{Id: req.Id, Status: "error", ErrMsg: err.Error(), Ts: time.Now().UnixMilli()})
+				continue
+			}
+			cl.hub.subscribe(cl, key, req.Sub)
+			cl.reply(WsRes{Id: req.Id, Source: key.source, Status: "ok", Subbed: req.Sub, Ts: time.Now().UnixMilli()})
+		case req.Unsub != "":
+			key, err := cl.hub.parseTopic(req.Source, req.Unsub)
+			if err != nil {
+				cl.reply(WsRes{Id: req.Id, Status: "error", ErrMsg: err.Error(), Ts: time.Now().UnixMilli()})
+				continue
+			}
+			cl.hub.unsubscribe(cl, key)
+			cl.reply(WsRes{Id: req.Id, Source: key.source, Status: "ok", Unsubbed: req.Unsub, Ts: time.Now().UnixMilli()})
+		}
+	}
+}
+
+func (cl *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		cl.close()
+	}()
+
+	for {
+		select {
+		case <-cl.done:
+			return
+		case msg := <-cl.send:
+			_ = cl.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := cl.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = cl.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := cl.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func wsTopic(symbol string, period string) string {
+	return fmt.Sprintf("market.%s.kline.%s", engine.NormalizeSymbol(symbol), period)
+}